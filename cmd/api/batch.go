@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"bookworm.onatim.com/internal/data"
+	"bookworm.onatim.com/internal/validator"
+)
+
+// The maximum number of operations accepted in a single batch.
+const maxBatchOperations = 100
+
+// Add a batchBooksHandler for the "POST /v1/books/batch" endpoint. This runs a list of
+// create, update and delete operations in one go. In "atomic" mode (the default) either
+// all operations succeed or none of them are applied; in "best_effort" mode each
+// operation succeeds or fails on its own. Either way, the response contains a result
+// for every operation, with the same status codes and messages that the single-book
+// endpoints would have sent.
+func (app *application) batchBooksHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Mode       string `json:"mode"`
+		Operations []struct {
+			Op      string         `json:"op"`
+			ID      int64          `json:"id"`
+			Version int32          `json:"version"`
+			Book    data.BookPatch `json:"book"`
+		} `json:"operations"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Mode == "" {
+		input.Mode = "atomic"
+	}
+
+	// Validate the mode and the shape of each operation. The books themselves are
+	// validated by the Batch() method, as updates need to be applied to the current
+	// version of the book first.
+	v := validator.New()
+
+	v.Check(validator.PermittedValue(input.Mode, "atomic", "best_effort"), "mode", "must be atomic or best_effort")
+	v.Check(len(input.Operations) >= 1, "operations", "must contain at least 1 operation")
+	v.Check(len(input.Operations) <= maxBatchOperations, "operations", fmt.Sprintf("must not contain more than %d operations", maxBatchOperations))
+
+	ops := make([]data.BatchOperation, len(input.Operations))
+
+	for i, op := range input.Operations {
+		key := fmt.Sprintf("operations[%d]", i)
+
+		v.Check(validator.PermittedValue(op.Op, data.BatchCreate, data.BatchUpdate, data.BatchDelete), key+".op", "must be create, update or delete")
+
+		if op.Op == data.BatchUpdate || op.Op == data.BatchDelete {
+			v.Check(op.ID > 0, key+".id", "must be provided")
+			v.Check(op.Version > 0, key+".version", "must be provided")
+		}
+
+		ops[i] = data.BatchOperation{
+			Op:      op.Op,
+			ID:      op.ID,
+			Version: op.Version,
+			Patch:   op.Book,
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	results, err := app.models.Books.WithContext(r.Context()).Batch(ops, input.Mode == "atomic", app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Convert each result into a response entry, mirroring the status codes and
+	// messages used by the error response helpers.
+	committed := true
+	response := make([]envelope, len(results))
+
+	for i, result := range results {
+		switch {
+		case result.Err == nil && ops[i].Op == data.BatchCreate:
+			response[i] = envelope{"status": http.StatusCreated, "book": result.Book}
+		case result.Err == nil && ops[i].Op == data.BatchDelete:
+			response[i] = envelope{"status": http.StatusOK, "message": "book successfully deleted"}
+		case result.Err == nil:
+			response[i] = envelope{"status": http.StatusOK, "book": result.Book}
+		case errors.Is(result.Err, data.ErrRecordNotFound):
+			response[i] = envelope{"status": http.StatusNotFound, "error": "the requested resource could not be found"}
+		case errors.Is(result.Err, data.ErrEditConflict):
+			response[i] = envelope{"status": http.StatusConflict, "error": "unable to update the record due to an edit conflict, please try again"}
+		case errors.Is(result.Err, data.ErrFailedValidation):
+			response[i] = envelope{"status": http.StatusUnprocessableEntity, "error": result.Errors}
+		case errors.Is(result.Err, data.ErrBatchAborted):
+			response[i] = envelope{"status": http.StatusFailedDependency, "error": "the operation was not applied because another operation in the batch failed"}
+		}
+
+		if result.Err != nil && input.Mode == "atomic" {
+			committed = false
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"committed": committed, "results": response}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"bookworm.onatim.com/internal/jsonlog"
+	"bookworm.onatim.com/internal/validator"
+)
+
+// Every setting in the config struct is declared as a command-line flag in main(), which
+// gives it a name, a default value and a way of parsing it. The functions in this file
+// let the same settings be read from a configuration file and from environment
+// variables too, so that secrets don't have to be passed on the command line (where
+// anyone can see them in the process list) or baked into the source. The layers are
+// applied in this order, with each one overriding the ones before it:
+//
+//  1. The default values of the flags.
+//  2. The configuration file named by the -config flag or BOOKWORM_CONFIG variable.
+//  3. Environment variables named after the flags, like BOOKWORM_DB_DSN for -db-dsn.
+//  4. The command-line flags themselves.
+
+// The prefix for the names of the environment variables which hold settings.
+const envPrefix = "BOOKWORM_"
+
+// The settings which hold secrets. Each of these can also be read from a file, using a
+// setting with "-file" on the end of its name, like -smtp-password-file or
+// BOOKWORM_SMTP_PASSWORD_FILE, which works well with Docker and systemd credentials.
+// Their values are redacted when the configuration is logged.
+var secretSettings = []string{"db-dsn", "smtp-password", "cursor-secret", "download-secret", "idempotency-secret"}
+
+// The registerSecretFileFlags() function declares the "-file" flag for each of the
+// secret settings. Setting one reads the file and sets the secret to its contents.
+func registerSecretFileFlags(fs *flag.FlagSet) {
+	for _, name := range secretSettings {
+		fs.Func(name+"-file", fmt.Sprintf("Read the value of -%s from a file", name), func(path string) error {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			// Files written by editors and most secret managers end with a newline,
+			// which isn't part of the secret.
+			return fs.Set(name, strings.TrimRight(string(content), "\r\n"))
+		})
+	}
+}
+
+// The loadConfig() function applies the settings from the configuration file and the
+// environment to fs, which must already have been parsed. Any settings which were given
+// as command-line flags are left alone, as they take precedence.
+func loadConfig(fs *flag.FlagSet, path string) error {
+	explicit := make(map[string]bool)
+
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	// A secret given on the command line, either directly or from a file, overrides
+	// both ways of giving it in the file and the environment.
+	for _, name := range secretSettings {
+		if explicit[name] || explicit[name+"-file"] {
+			explicit[name] = true
+			explicit[name+"-file"] = true
+		}
+	}
+
+	if path == "" {
+		path = os.Getenv(envPrefix + "CONFIG")
+	}
+
+	if path != "" {
+		err := loadConfigFile(fs, path, explicit)
+		if err != nil {
+			return err
+		}
+	}
+
+	return loadConfigEnv(fs, explicit)
+}
+
+// The loadConfigFile() function reads a configuration file, which has one setting per
+// line in the form "name = value", where the name is that of the flag. Blank lines and
+// lines starting with # are ignored, and values may be quoted with double quotes. For
+// example:
+//
+//	# Settings for the staging server.
+//	env = staging
+//	db-dsn-file = /run/secrets/db-dsn
+//	cors-trusted-origins = "https://staging.example.com https://admin.example.com"
+func loadConfigFile(fs *flag.FlagSet, path string, explicit map[string]bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected a setting in the form name = value", path, n)
+		}
+
+		name = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, `"`) {
+			value, err = strconv.Unquote(value)
+			if err != nil {
+				return fmt.Errorf("%s:%d: invalid quoted value for %s", path, n, name)
+			}
+		}
+
+		if fs.Lookup(name) == nil || name == "config" || name == "version" {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, n, name)
+		}
+
+		if explicit[name] {
+			continue
+		}
+
+		err = fs.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid value for %s: %w", path, n, name, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// The loadConfigEnv() function reads a setting from the environment variable for each
+// flag, which is its name in upper case with dashes replaced by underscores, plus the
+// BOOKWORM_ prefix.
+func loadConfigEnv(fs *flag.FlagSet, explicit map[string]bool) error {
+	var err error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "config" || f.Name == "version" {
+			return
+		}
+
+		key := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+
+		value, ok := os.LookupEnv(key)
+		if !ok {
+			return
+		}
+
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value for %s: %w", key, setErr)
+		}
+	})
+
+	return err
+}
+
+// The validateConfig() function checks that the settings make sense together, so that
+// mistakes are reported clearly at startup rather than causing confusing failures
+// later on. The errors are keyed by the name of the setting.
+func validateConfig(v *validator.Validator, cfg config) {
+	v.Check(cfg.port > 0 && cfg.port <= 65535, "port", "must be between 1 and 65535")
+	v.Check(validator.PermittedValue(cfg.env, "development", "staging", "production"), "env", "must be development, staging or production")
+
+	v.Check(cfg.db.dsn != "", "db-dsn", "must be provided")
+	v.Check(cfg.db.maxIdleConns <= cfg.db.maxOpenConns || cfg.db.maxOpenConns <= 0, "db-max-idle-conns", "must not be more than db-max-open-conns")
+
+	_, err := time.ParseDuration(cfg.db.maxIdleTime)
+	v.Check(err == nil, "db-max-idle-time", "must be a duration, like 15m")
+
+	if cfg.limiter.enabled {
+		v.Check(cfg.limiter.rps > 0, "limiter-rps", "must be greater than zero")
+		v.Check(cfg.limiter.burst > 0, "limiter-burst", "must be greater than zero")
+		v.Check(cfg.limiter.user.RPS > 0, "limiter-user-rps", "must be greater than zero")
+		v.Check(cfg.limiter.user.Burst > 0, "limiter-user-burst", "must be greater than zero")
+		v.Check(cfg.limiter.auth.RPS > 0, "limiter-auth-rps", "must be greater than zero")
+		v.Check(cfg.limiter.auth.Burst > 0, "limiter-auth-burst", "must be greater than zero")
+		v.Check(cfg.limiter.ip.RPS > 0, "limiter-ip-rps", "must be greater than zero")
+		v.Check(cfg.limiter.ip.Burst > 0, "limiter-ip-burst", "must be greater than zero")
+
+		for code, rate := range cfg.limiter.tiers {
+			v.Check(rate.RPS > 0 && rate.Burst > 0, "limiter-tiers", fmt.Sprintf("rate for %q must be greater than zero", code))
+		}
+	}
+	v.Check(validator.PermittedValue(cfg.limiter.store, "memory", "postgres"), "limiter-store", "must be memory or postgres")
+
+	v.Check(cfg.smtp.host != "", "smtp-host", "must be provided")
+	v.Check(cfg.smtp.port > 0 && cfg.smtp.port <= 65535, "smtp-port", "must be between 1 and 65535")
+	v.Check(cfg.smtp.password == "" || cfg.smtp.username != "", "smtp-username", "must be provided with smtp-password")
+
+	_, err = mail.ParseAddress(cfg.smtp.sender)
+	v.Check(err == nil, "smtp-sender", `must be an email address, like "Bookworm <no-reply@example.com>"`)
+
+	for _, origin := range cfg.cors.trustedOrigins {
+		v.Check(isAbsoluteURL(origin), "cors-trusted-origins", fmt.Sprintf("%q must be an origin, like https://example.com", origin))
+	}
+
+	v.Check(cfg.storage.dir != "", "storage-dir", "must be provided")
+
+	v.Check(validator.PermittedValue(cfg.metadata.provider, "openlibrary", "none"), "metadata-provider", "must be openlibrary or none")
+	if cfg.metadata.provider != "none" {
+		v.Check(isAbsoluteURL(cfg.metadata.url), "metadata-url", "must be an absolute URL")
+		v.Check(cfg.metadata.timeout > 0, "metadata-timeout", "must be greater than zero")
+	}
+
+	v.Check(cfg.trash.retention > 0, "trash-retention", "must be greater than zero")
+	v.Check(cfg.recommendations.interval > 0, "recommendations-interval", "must be greater than zero")
+	v.Check(cfg.shutdown.drain >= 0, "shutdown-drain", "must not be negative")
+
+	v.Check(cfg.tracing.endpoint == "" || isAbsoluteURL(cfg.tracing.endpoint), "otlp-endpoint", "must be an absolute URL")
+	v.Check(cfg.tracing.sampleRatio >= 0 && cfg.tracing.sampleRatio <= 1, "trace-sample-ratio", "must be between 0 and 1")
+
+	// Secrets which are too short are easy to guess. If they aren't provided, random
+	// ones are generated instead.
+	v.Check(len(cfg.cursor.secret) == 0 || len(cfg.cursor.secret) >= 32, "cursor-secret", "must be at least 32 bytes long")
+	v.Check(len(cfg.download.secret) == 0 || len(cfg.download.secret) >= 32, "download-secret", "must be at least 32 bytes long")
+	v.Check(len(cfg.idempotency.secret) == 0 || len(cfg.idempotency.secret) >= 32, "idempotency-secret", "must be at least 32 bytes long")
+}
+
+func isAbsoluteURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// The configAttrs() function returns the effective settings as log attributes, keyed
+// by the names of the flags, with the values of any secrets redacted.
+func configAttrs(cfg config) []jsonlog.Attr {
+	return []jsonlog.Attr{
+		jsonlog.Int("port", cfg.port),
+		jsonlog.String("env", cfg.env),
+		jsonlog.Any("log-level", cfg.log.level),
+		jsonlog.String("db-dsn", redactDSN(cfg.db.dsn)),
+		jsonlog.Int("db-max-open-conns", cfg.db.maxOpenConns),
+		jsonlog.Int("db-max-idle-conns", cfg.db.maxIdleConns),
+		jsonlog.String("db-max-idle-time", cfg.db.maxIdleTime),
+		jsonlog.Bool("db-auto-migrate", cfg.db.autoMigrate),
+		jsonlog.Bool("limiter-enabled", cfg.limiter.enabled),
+		jsonlog.Float64("limiter-rps", cfg.limiter.rps),
+		jsonlog.Int("limiter-burst", cfg.limiter.burst),
+		jsonlog.Float64("limiter-user-rps", cfg.limiter.user.RPS),
+		jsonlog.Int("limiter-user-burst", cfg.limiter.user.Burst),
+		jsonlog.Float64("limiter-auth-rps", cfg.limiter.auth.RPS),
+		jsonlog.Int("limiter-auth-burst", cfg.limiter.auth.Burst),
+		jsonlog.Float64("limiter-ip-rps", cfg.limiter.ip.RPS),
+		jsonlog.Int("limiter-ip-burst", cfg.limiter.ip.Burst),
+		jsonlog.Any("limiter-tiers", cfg.limiter.tiers),
+		jsonlog.String("limiter-store", cfg.limiter.store),
+		jsonlog.String("smtp-host", cfg.smtp.host),
+		jsonlog.Int("smtp-port", cfg.smtp.port),
+		jsonlog.String("smtp-username", cfg.smtp.username),
+		jsonlog.String("smtp-password", redact(cfg.smtp.password)),
+		jsonlog.String("smtp-sender", cfg.smtp.sender),
+		jsonlog.Bool("healthcheck-smtp", cfg.healthcheck.smtp),
+		jsonlog.Duration("shutdown-drain", cfg.shutdown.drain),
+		jsonlog.Any("cors-trusted-origins", cfg.cors.trustedOrigins),
+		jsonlog.Any("trusted-proxies", cfg.proxies.trusted),
+		jsonlog.String("storage-dir", cfg.storage.dir),
+		jsonlog.String("metadata-provider", cfg.metadata.provider),
+		jsonlog.String("metadata-url", cfg.metadata.url),
+		jsonlog.Duration("metadata-timeout", cfg.metadata.timeout),
+		jsonlog.Bool("metadata-enrich", cfg.metadata.enrich),
+		jsonlog.Duration("trash-retention", cfg.trash.retention),
+		jsonlog.Duration("recommendations-interval", cfg.recommendations.interval),
+		jsonlog.String("otlp-endpoint", cfg.tracing.endpoint),
+		jsonlog.Float64("trace-sample-ratio", cfg.tracing.sampleRatio),
+		jsonlog.Bool("access-log", cfg.accessLog.enabled),
+		jsonlog.Any("access-log-sample", cfg.accessLog.sampling),
+		jsonlog.String("cursor-secret", redact(string(cfg.cursor.secret))),
+		jsonlog.String("download-secret", redact(string(cfg.download.secret))),
+		jsonlog.String("idempotency-secret", redact(string(cfg.idempotency.secret))),
+	}
+}
+
+// Secrets which aren't set are left empty, so that it's clear from the log whether
+// they were provided.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// Only the password in a DSN is secret, and the rest of it is useful to see. DSNs in
+// URL form have the password replaced, while those in the key=value form are redacted
+// entirely.
+func redactDSN(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil || u.Scheme == "" {
+		return redact(dsn)
+	}
+
+	query := u.Query()
+	if query.Has("password") {
+		query.Set("password", "xxxxx")
+		u.RawQuery = query.Encode()
+	}
+
+	return u.Redacted()
+}
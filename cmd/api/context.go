@@ -5,20 +5,42 @@ import (
 	"net/http"
 
 	"bookworm.onatim.com/internal/data"
+	"bookworm.onatim.com/internal/jsonlog"
 )
 
 // Define a custom contextKey type for context operations.
 type contextKey string
 
-// Define a context key for user operations.
-const userContextKey = contextKey("user")
+// Define context keys for user, client IP address, route and tracing operations.
+const (
+	userContextKey       = contextKey("user")
+	userHolderContextKey = contextKey("user_holder")
+	clientIPContextKey   = contextKey("client_ip")
+	routeContextKey      = contextKey("route")
+	parentSpanContextKey = contextKey("parent_span")
+)
 
 // Returns a new copy of the request with the provided User struct added to the context.
+// If the request has a user holder (see contextSetUserHolder()) the user is also stored
+// there.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	if holder, ok := r.Context().Value(userHolderContextKey).(**data.User); ok {
+		*holder = user
+	}
+
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 }
 
+// Returns a new copy of the request with a holder for the user added to the context.
+// The authenticate() middleware runs further down the chain, and the copy of the
+// request that it adds the user to isn't visible to the middleware above it, so this
+// lets the access log find out who made the request.
+func (app *application) contextSetUserHolder(r *http.Request, holder **data.User) *http.Request {
+	ctx := context.WithValue(r.Context(), userHolderContextKey, holder)
+	return r.WithContext(ctx)
+}
+
 // Retrieves the User struct from the request context.
 func (app *application) contextGetUser(r *http.Request) *data.User {
 	user, ok := r.Context().Value(userContextKey).(*data.User)
@@ -27,3 +49,48 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// Returns a new copy of the request with the client's IP address added to the context.
+func (app *application) contextSetClientIP(r *http.Request, ip string) *http.Request {
+	ctx := context.WithValue(r.Context(), clientIPContextKey, ip)
+	return r.WithContext(ctx)
+}
+
+// Returns a new copy of the request with a logger for the request added to the context.
+func (app *application) contextSetLogger(r *http.Request, logger *jsonlog.Logger) *http.Request {
+	ctx := jsonlog.NewContext(r.Context(), logger)
+	return r.WithContext(ctx)
+}
+
+// Retrieves the request's logger from the context, which carries the request and trace
+// IDs, falling back to the application logger if it hasn't been set yet.
+func (app *application) contextGetLogger(r *http.Request) *jsonlog.Logger {
+	if logger := jsonlog.FromContext(r.Context()); logger != nil {
+		return logger
+	}
+	return app.logger
+}
+
+// Retrieves the client's IP address from the request context.
+func (app *application) contextGetClientIP(r *http.Request) string {
+	ip, ok := r.Context().Value(clientIPContextKey).(string)
+	if !ok {
+		panic("missing client IP value in request context")
+	}
+	return ip
+}
+
+// Returns a new copy of the request with a holder for the matched route pattern added
+// to the context. The router fills it in, so that middleware further up the chain can
+// see which route the request matched.
+func (app *application) contextSetRoute(r *http.Request, route *string) *http.Request {
+	ctx := context.WithValue(r.Context(), routeContextKey, route)
+	return r.WithContext(ctx)
+}
+
+// Retrieves the holder for the matched route pattern from the request context, or nil
+// if there isn't one.
+func (app *application) contextGetRoute(r *http.Request) *string {
+	route, _ := r.Context().Value(routeContextKey).(*string)
+	return route
+}
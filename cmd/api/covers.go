@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"path"
+
+	"bookworm.onatim.com/internal/data"
+	"bookworm.onatim.com/internal/storage"
+	"bookworm.onatim.com/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// The maximum size of an uploaded cover image, both in bytes and in pixels. Limiting
+// the number of pixels stops small but highly compressed images from using up a lot
+// of memory when they're decoded.
+const (
+	maxCoverBytes  = 10 << 20
+	maxCoverPixels = 40_000_000
+)
+
+// Add an updateBookCoverHandler for the "PUT /v1/books/:id/cover" endpoint. The request
+// body is the raw JPEG or PNG image, which is stored along with a thumbnail for each
+// of the data.CoverSizes. Any previous cover is deleted once the new one is in place.
+func (app *application) updateBookCoverHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	book, err := app.models.Books.WithContext(r.Context()).Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && !etagMatches(ifMatch, etag(book.Version, false), true) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	// Images are a lot larger than the JSON bodies which readJSON() accepts, so the
+	// body is read here with its own limit.
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCoverBytes))
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesError):
+			app.badRequestResponse(w, r, fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit))
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	img, ext, err := decodeCover(body)
+	if err != nil {
+		switch {
+		case errors.Is(err, errCoverFormat):
+			app.unsupportedMediaTypeResponse(w, r, "image/jpeg", "image/png")
+		case errors.Is(err, errCoverTooLarge):
+			v := validator.New()
+			v.AddError("cover", fmt.Sprintf("must not be larger than %d pixels", maxCoverPixels))
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.badRequestResponse(w, r, fmt.Errorf("body contains an invalid image: %w", err))
+		}
+		return
+	}
+
+	cover, err := app.storeCover(r.Context(), book.ID, body, img, ext)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	previous := book.Cover
+
+	err = app.models.Books.WithContext(r.Context()).SetCover(book, cover)
+	if err != nil {
+		app.deleteObjects(cover.Keys()...)
+		switch {
+		case errors.Is(err, data.ErrEditConflict) && ifMatch != "":
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if previous != "" {
+		app.deleteObjects(previous.Keys()...)
+	}
+
+	headers := make(http.Header)
+	setBookCacheHeaders(headers, book, false)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": book, "cover_urls": cover.URLs()}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add a deleteBookCoverHandler for the "DELETE /v1/books/:id/cover" endpoint, which
+// removes the cover of a book.
+func (app *application) deleteBookCoverHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	book, err := app.models.Books.WithContext(r.Context()).Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && !etagMatches(ifMatch, etag(book.Version, false), true) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	if book.Cover == "" {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	previous := book.Cover
+
+	err = app.models.Books.WithContext(r.Context()).SetCover(book, "")
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict) && ifMatch != "":
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.deleteObjects(previous.Keys()...)
+
+	headers := make(http.Header)
+	setBookCacheHeaders(headers, book, false)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add a showCoverHandler for the "GET /v1/covers/*path" endpoint, which serves cover
+// images and their thumbnails from storage. Cover keys are never reused, so the
+// responses can be cached by clients forever.
+func (app *application) showCoverHandler(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	// The path parameter includes its leading slash, so this gives us a key like
+	// "covers/12/3fa9c1d2.jpg". Only keys under covers/ can be reached from here.
+	key := "covers" + params.ByName("path")
+
+	f, err := app.storage.Open(r.Context(), key)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound), errors.Is(err, storage.ErrInvalidKey):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+
+	// http.ServeContent() sets the Content-Type based on the file extension, and
+	// handles Range and If-Modified-Since requests.
+	http.ServeContent(w, r, key, info.ModTime(), f)
+}
+
+// Errors returned by decodeCover() for images which can't be used as a cover.
+var (
+	errCoverFormat   = errors.New("cover must be a JPEG or PNG image")
+	errCoverTooLarge = errors.New("cover has too many pixels")
+)
+
+// The decodeCover() function checks that an image can be used as a cover, and decodes
+// it. It also returns the file extension to store the image with.
+func decodeCover(body []byte) (image.Image, string, error) {
+	// Work out the type of the image from its contents rather than trusting the
+	// Content-Type header.
+	var ext string
+
+	switch http.DetectContentType(body) {
+	case "image/jpeg":
+		ext = ".jpg"
+	case "image/png":
+		ext = ".png"
+	default:
+		return nil, "", errCoverFormat
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if config.Width*config.Height > maxCoverPixels {
+		return nil, "", errCoverTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return img, ext, nil
+}
+
+// The storeCover() method stores the original cover image for a book and generates its
+// thumbnails, returning the new cover. The cover is stored under a random key, so that
+// its URL changes whenever the cover does and it can be cached indefinitely. If any of
+// the images can't be stored, the ones which were are deleted again.
+func (app *application) storeCover(ctx context.Context, bookID int64, original []byte, img image.Image, ext string) (data.Cover, error) {
+	name, err := randomName()
+	if err != nil {
+		return "", err
+	}
+
+	cover := data.Cover(fmt.Sprintf("covers/%d/%s%s", bookID, name, ext))
+
+	err = app.putCover(ctx, cover, original, img)
+	if err != nil {
+		app.deleteObjects(cover.Keys()...)
+		return "", err
+	}
+
+	return cover, nil
+}
+
+// The putCover() method puts the original cover image and its thumbnails in storage.
+// Each thumbnail is made from the next larger one, which is a lot quicker than scaling
+// down the original every time.
+func (app *application) putCover(ctx context.Context, cover data.Cover, original []byte, img image.Image) error {
+	err := app.storage.Put(ctx, cover.Key(""), bytes.NewReader(original))
+	if err != nil {
+		return err
+	}
+
+	for i := len(data.CoverSizes) - 1; i >= 0; i-- {
+		size := data.CoverSizes[i]
+
+		img = thumbnail(img, size.Width)
+
+		var buf bytes.Buffer
+
+		switch path.Ext(string(cover)) {
+		case ".png":
+			err = png.Encode(&buf, img)
+		default:
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+		}
+		if err != nil {
+			return err
+		}
+
+		err = app.storage.Put(ctx, cover.Key(size.Name), &buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The thumbnail() function scales an image down to the given width, keeping its aspect
+// ratio. Each pixel of the thumbnail is the average of the block of pixels it covers in
+// the source image, which gives much smoother results than just picking one of them.
+// Images which are already narrow enough are returned unchanged.
+func thumbnail(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+	if bounds.Dx() <= width {
+		return src
+	}
+
+	height := max(1, bounds.Dy()*width/bounds.Dx())
+	dst := image.NewRGBA64(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*bounds.Dy()/height)
+
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*bounds.Dx()/width)
+
+			var r, g, b, a, n uint64
+
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					sr, sg, sb, sa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(sr), g+uint64(sg), b+uint64(sb), a+uint64(sa)
+					n++
+				}
+			}
+
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+
+	return dst
+}
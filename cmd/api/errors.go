@@ -2,21 +2,38 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bookworm.onatim.com/internal/jsonlog"
+	"bookworm.onatim.com/internal/tracing"
 )
 
-// Logs a structured error message.
+// Logs a structured error message, and marks the current span as failed. The request's
+// logger carries the request and trace IDs, so that the log entry can be matched up
+// with the access log and the request's spans.
 func (app *application) logError(r *http.Request, err error) {
-	app.logger.PrintError(err, map[string]string{
-		"request_method": r.Method,
-		"request_url":    r.URL.String(),
-	})
+	tracing.SpanFromContext(r.Context()).SetError(err)
+
+	app.contextGetLogger(r).Error(err,
+		jsonlog.String("request_method", r.Method),
+		jsonlog.String("request_url", r.URL.String()),
+		jsonlog.String("client_ip", app.contextGetClientIP(r)),
+	)
 }
 
-// Sends a JSON-formatted error message to the client with the given status code.
+// Sends a JSON-formatted error message to the client with the given status code. The
+// trace ID is included so that clients can quote it when reporting a problem.
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
 	env := envelope{"error": message}
 
+	if span := tracing.SpanFromContext(r.Context()); span != nil {
+		env["trace_id"] = span.TraceID()
+	}
+
 	// Writes the response using writeJSON(). Logs and sends a 500 status if it fails.
 	err := app.writeJSON(w, status, env, nil)
 	if err != nil {
@@ -55,14 +72,30 @@ func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.
 	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
 }
 
+// Sends a 415 Unsupported Media Type response listing the content types we accept.
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, supported ...string) {
+	message := fmt.Sprintf("the request body must have one of the content types: %s", strings.Join(supported, ", "))
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
+
 // Sends a 409 Conflict response indicating an edit conflict.
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
-// Sends a 429 Too Many Requests response indicating a rate limit exceeded.
-func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+// Sends a 412 Precondition Failed response indicating that the If-Match header didn't
+// match the current version of the resource.
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the resource has been modified since the version given in the If-Match header"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
+// Sends a 429 Too Many Requests response indicating a rate limit exceeded, with a
+// Retry-After header giving the number of seconds until the client can try again.
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds())))))
+
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
@@ -100,3 +133,29 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+// The idempotencyConflictResponse() method will be used to send a 409 Conflict status
+// code and JSON response to the client when a request is retried while the first
+// request with the same idempotency key is still being processed.
+func (app *application) idempotencyConflictResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a request with this Idempotency-Key header is still being processed, please try again later"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// The invalidDownloadURLResponse() method will be used to send a 403 Forbidden status
+// code and JSON response to the client when a signed download URL has expired or its
+// signature doesn't match.
+func (app *application) invalidDownloadURLResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or expired download URL"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// The badGatewayResponse() method will be used to send a 502 Bad Gateway status code
+// and JSON response to the client when an external service we depend on fails. The
+// error is logged, but not sent to the client.
+func (app *application) badGatewayResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.logError(r, err)
+
+	message := "an upstream service failed to process the request, please try again later"
+	app.errorResponse(w, r, http.StatusBadGateway, message)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bookworm.onatim.com/internal/data"
+	"bookworm.onatim.com/internal/validator"
+)
+
+// Flush the response to the client after writing this many books, so that large
+// exports start arriving straight away.
+const exportFlushInterval = 100
+
+// Add an exportBooksHandler for the "GET /v1/books/export" endpoint. This accepts the
+// same title, genres and sort query string values as listBooksHandler, and streams
+// every matching book to the client as CSV or NDJSON. Unlike writeJSON(), which
+// marshals the whole response in memory, each book is written as soon as it's read
+// from the database.
+func (app *application) exportBooksHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title  string
+		Genres []string
+		Format string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Title = app.readString(qs, "title", "")
+	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.Format = app.readString(qs, "format", "csv")
+
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "title", "year", "isbn", "-id", "-title", "-year", "-isbn"}
+
+	// Pagination doesn't apply to exports, so we only check the sort value here rather
+	// than calling ValidateFilters().
+	v.Check(validator.PermittedValue(input.Filters.Sort, input.Filters.SortSafelist...), "sort", "invalid sort value")
+	v.Check(validator.PermittedValue(input.Format, "csv", "ndjson"), "format", "must be csv or ndjson")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Resolve the genres to filter by into their slugs, in the same way as
+	// listBooksHandler.
+	taxonomy, err := app.models.Genres.WithContext(r.Context()).Taxonomy()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	input.Genres = taxonomy.Normalize(input.Genres)
+
+	// Set up the functions which write a single book in the requested format, and
+	// flush any buffered data through to the client.
+	var writeBook func(*data.Book) error
+	var flush func() error
+
+	rc := http.NewResponseController(w)
+	cw := csv.NewWriter(w)
+
+	switch input.Format {
+	case "csv":
+		writeBook = func(book *data.Book) error {
+			return cw.Write([]string{
+				strconv.FormatInt(book.ID, 10),
+				book.Title,
+				strconv.Itoa(int(book.Year)),
+				strconv.Itoa(int(book.ISBN)),
+				strings.Join(book.Genres, ","),
+				strconv.Itoa(int(book.Version)),
+			})
+		}
+		flush = func() error {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+	case "ndjson":
+		enc := json.NewEncoder(w)
+		writeBook = func(book *data.Book) error {
+			return enc.Encode(book)
+		}
+		flush = rc.Flush
+	}
+
+	// Exports can take longer than the server's write timeout, so remove the write
+	// deadline for this response. Disconnected clients are still detected through the
+	// request context.
+	err = rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Set the headers which tell the client to save the response as a file.
+	filename := fmt.Sprintf("books-%s.%s", time.Now().UTC().Format("20060102"), input.Format)
+
+	switch input.Format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	// CSV exports start with a header row. The id and version columns are ignored by
+	// the "POST /v1/books/import" endpoint, so an export can be imported again.
+	if input.Format == "csv" {
+		err = cw.Write([]string{"id", "title", "year", "isbn", "genres", "version"})
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+	}
+
+	count := 0
+
+	// Stream the books, passing the request context so that the query is cancelled if
+	// the client goes away.
+	err = app.models.Books.Export(r.Context(), input.Title, input.Genres, input.Filters, func(book *data.Book) error {
+		err := writeBook(book)
+		if err != nil {
+			return err
+		}
+
+		count++
+		if count%exportFlushInterval == 0 {
+			return flush()
+		}
+
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+
+	// We've already sent the status code and part of the body, so if anything went
+	// wrong all we can do is log the error. A cancelled request context just means the
+	// client disconnected, which isn't worth logging.
+	if err != nil && r.Context().Err() == nil {
+		app.logError(r, err)
+	}
+}
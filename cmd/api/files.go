@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"bookworm.onatim.com/internal/data"
+	"bookworm.onatim.com/internal/storage"
+	"github.com/julienschmidt/httprouter"
+)
+
+// The maximum size of an uploaded ebook file, and how long a signed download URL is
+// valid for.
+const (
+	maxBookFileBytes = 100 << 20
+	downloadURLTTL   = 5 * time.Minute
+)
+
+// Add a listBookFilesHandler for the "GET /v1/books/:id/files" endpoint, which returns
+// the ebook files attached to a book.
+func (app *application) listBookFilesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// Check that the book exists, so that we don't send an empty list for a book which
+	// isn't there.
+	_, err = app.models.Books.WithContext(r.Context()).Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	files, err := app.models.Files.WithContext(r.Context()).GetAllForBook(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"files": files}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add an uploadBookFileHandler for the "PUT /v1/books/:id/files/:format" endpoint. The
+// request body is the raw EPUB or PDF file, which is streamed to storage while its
+// checksum is calculated, so that large files never have to be held in memory.
+func (app *application) uploadBookFileHandler(w http.ResponseWriter, r *http.Request) {
+	id, format, err := app.readFileParams(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// Uploads can take a lot longer than the server's read timeout, so clear the read
+	// deadline for this request.
+	err = http.NewResponseController(w).SetReadDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Check the start of the file to make sure that it's really in the format the
+	// client says it is.
+	body := bufio.NewReader(http.MaxBytesReader(w, r.Body, maxBookFileBytes))
+
+	head, _ := body.Peek(58)
+	if !hasFileSignature(format, head) {
+		app.unsupportedMediaTypeResponse(w, r, data.FileFormats[format])
+		return
+	}
+
+	name, err := randomName()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	file := &data.BookFile{
+		BookID: id,
+		Format: format,
+		Key:    fmt.Sprintf("files/%d/%s.%s", id, name, format),
+	}
+
+	// Copy the body to storage, hashing and counting the bytes as they go past.
+	hash := sha256.New()
+	counter := &byteCounter{}
+
+	err = app.storage.Put(r.Context(), file.Key, io.TeeReader(body, io.MultiWriter(hash, counter)))
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesError):
+			app.badRequestResponse(w, r, fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit))
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	file.Size = counter.n
+	file.Checksum = hex.EncodeToString(hash.Sum(nil))
+
+	previous, err := app.models.Files.WithContext(r.Context()).Put(file)
+	if err != nil {
+		app.deleteObjects(file.Key)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if previous != "" {
+		app.deleteObjects(previous)
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/books/%d/files/%s", id, format))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"file": file}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add a downloadBookFileHandler for the "GET /v1/books/:id/files/:format" endpoint.
+// The file is served with http.ServeContent(), which handles Range requests so that
+// interrupted downloads can be resumed, as well as If-None-Match and If-Range requests
+// against the ETag, which is the checksum of the file.
+func (app *application) downloadBookFileHandler(w http.ResponseWriter, r *http.Request) {
+	id, format, err := app.readFileParams(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	file, err := app.models.Files.WithContext(r.Context()).Get(id, format)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	f, err := app.storage.Open(r.Context(), file.Key)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer f.Close()
+
+	// Downloads can take a lot longer than the server's write timeout, so clear the
+	// write deadline for this response.
+	err = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", strconv.Quote(file.Checksum))
+	w.Header().Set("Content-Type", data.FileFormats[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="book-%d.%s"`, id, format))
+	w.Header().Set("Cache-Control", "private")
+
+	http.ServeContent(w, r, "", file.CreatedAt, f)
+}
+
+// Add a deleteBookFileHandler for the "DELETE /v1/books/:id/files/:format" endpoint.
+func (app *application) deleteBookFileHandler(w http.ResponseWriter, r *http.Request) {
+	id, format, err := app.readFileParams(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	key, err := app.models.Files.WithContext(r.Context()).Delete(id, format)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.deleteObjects(key)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "file successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add a createDownloadURLHandler for the "POST /v1/books/:id/files/:format/url"
+// endpoint. This returns a signed URL for downloading the file which works without an
+// Authorization header for a few minutes, so that it can be used in an <a> link.
+func (app *application) createDownloadURLHandler(w http.ResponseWriter, r *http.Request) {
+	id, format, err := app.readFileParams(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	_, err = app.models.Files.WithContext(r.Context()).Get(id, format)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	path := fmt.Sprintf("/v1/books/%d/files/%s", id, format)
+	expiry := time.Now().Add(downloadURLTTL).Truncate(time.Second)
+
+	qs := url.Values{}
+	qs.Set("expires", strconv.FormatInt(expiry.Unix(), 10))
+	qs.Set("signature", app.signDownload(path, expiry.Unix()))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"url": path + "?" + qs.Encode(), "expiry": expiry}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The requireSignatureOrPermission() middleware lets requests with a valid, unexpired
+// download signature through without checking who is making them. Requests without a
+// signature must come from a user with the given permission, as usual.
+func (app *application) requireSignatureOrPermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	withPermission := app.requirePermission(code, next)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		qs := r.URL.Query()
+
+		if !qs.Has("signature") {
+			withPermission(w, r)
+			return
+		}
+
+		expires, err := strconv.ParseInt(qs.Get("expires"), 10, 64)
+		if err != nil || time.Now().Unix() > expires {
+			app.invalidDownloadURLResponse(w, r)
+			return
+		}
+
+		signature, err := hex.DecodeString(qs.Get("signature"))
+		if err != nil {
+			app.invalidDownloadURLResponse(w, r)
+			return
+		}
+
+		expected, _ := hex.DecodeString(app.signDownload(r.URL.Path, expires))
+
+		// Use hmac.Equal() to compare the signatures in constant time.
+		if !hmac.Equal(signature, expected) {
+			app.invalidDownloadURLResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// The signDownload() method returns the hex-encoded HMAC-SHA256 signature for a
+// download URL with the given path and expiry time.
+func (app *application) signDownload(path string, expires int64) string {
+	mac := hmac.New(sha256.New, app.config.download.secret)
+	mac.Write([]byte(path + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Retrieve the "id" and "format" URL parameters from the current request context. An
+// error is returned if either is invalid.
+func (app *application) readFileParams(r *http.Request) (int64, string, error) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		return 0, "", err
+	}
+
+	format := httprouter.ParamsFromContext(r.Context()).ByName("format")
+	if _, ok := data.FileFormats[format]; !ok {
+		return 0, "", errors.New("invalid format parameter")
+	}
+
+	return id, format, nil
+}
+
+// The hasFileSignature() function reports whether the start of a file has the magic
+// bytes for the given format. EPUB files are zip archives whose first entry must be an
+// uncompressed file called "mimetype" containing the EPUB content type.
+func hasFileSignature(format string, head []byte) bool {
+	switch format {
+	case "pdf":
+		return bytes.HasPrefix(head, []byte("%PDF-"))
+	case "epub":
+		return bytes.HasPrefix(head, []byte("PK\x03\x04")) && len(head) >= 58 && string(head[30:58]) == "mimetypeapplication/epub+zip"
+	default:
+		return false
+	}
+}
+
+// A byteCounter is an io.Writer which counts the bytes written to it.
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	c.n += int64(len(b))
+	return len(b), nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"bookworm.onatim.com/internal/data"
+	"bookworm.onatim.com/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Add a listGenresHandler for the "GET /v1/genres" endpoint, which returns every genre
+// along with the number of books in it (including its sub-genres). The optional parent
+// query string value limits the list to the direct sub-genres of that genre.
+func (app *application) listGenresHandler(w http.ResponseWriter, r *http.Request) {
+	parent := app.readString(r.URL.Query(), "parent", "")
+
+	genres, err := app.models.Genres.WithContext(r.Context()).GetAll(data.Slugify(parent))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"genres": genres}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add a showGenreHandler for the "GET /v1/genres/:slug" endpoint.
+func (app *application) showGenreHandler(w http.ResponseWriter, r *http.Request) {
+	genre, err := app.models.Genres.WithContext(r.Context()).Get(readSlugParam(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"genre": genre}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add a createGenreHandler for the "POST /v1/genres" endpoint. If the client doesn't
+// send a slug, one is made from the name.
+func (app *application) createGenreHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Slug    string   `json:"slug"`
+		Name    string   `json:"name"`
+		Parent  string   `json:"parent"`
+		Aliases []string `json:"aliases"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Slug == "" {
+		input.Slug = input.Name
+	}
+
+	genre := &data.Genre{
+		Slug:    data.Slugify(input.Slug),
+		Name:    input.Name,
+		Parent:  data.Slugify(input.Parent),
+		Aliases: slugifyAll(input.Aliases),
+	}
+
+	taxonomy, err := app.models.Genres.WithContext(r.Context()).Taxonomy()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateGenre(v, genre); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if existing, ok := taxonomy.Resolve(genre.Slug); ok {
+		v.AddError("slug", fmt.Sprintf("is already used by the genre %q", existing))
+	}
+
+	if validateGenreTaxonomy(v, taxonomy, genre); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Genres.WithContext(r.Context()).Insert(genre)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateGenre):
+			v.AddError("slug", "a genre with this slug or alias already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/genres/%s", genre.Slug))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"genre": genre}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add an updateGenreHandler for the "PATCH /v1/genres/:slug" endpoint. The name, parent
+// and aliases can be changed, but not the slug, as it's stored in the books. Sending an
+// empty parent makes the genre a top-level genre.
+func (app *application) updateGenreHandler(w http.ResponseWriter, r *http.Request) {
+	genre, err := app.models.Genres.WithContext(r.Context()).Get(readSlugParam(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Name    *string  `json:"name"`
+		Parent  *string  `json:"parent"`
+		Aliases []string `json:"aliases"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		genre.Name = *input.Name
+	}
+	if input.Parent != nil {
+		genre.Parent = data.Slugify(*input.Parent)
+	}
+	if input.Aliases != nil {
+		genre.Aliases = slugifyAll(input.Aliases)
+	}
+
+	taxonomy, err := app.models.Genres.WithContext(r.Context()).Taxonomy()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateGenre(v, genre); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Moving a genre under one of its own sub-genres would create a loop.
+	if genre.Parent != "" && taxonomy.IsAncestor(genre.Slug, genre.Parent) {
+		v.AddError("parent", "must not be one of the genre's sub-genres")
+	}
+
+	if validateGenreTaxonomy(v, taxonomy, genre); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Genres.WithContext(r.Context()).Update(genre)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateGenre):
+			v.AddError("aliases", "must not contain an alias of another genre")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"genre": genre}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add a deleteGenreHandler for the "DELETE /v1/genres/:slug" endpoint. Genres which are
+// still used by any books can't be deleted. The sub-genres of a deleted genre are moved
+// up to its parent.
+func (app *application) deleteGenreHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.models.Genres.WithContext(r.Context()).Delete(readSlugParam(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrGenreInUse):
+			app.errorResponse(w, r, http.StatusConflict, "the genre is still used by one or more books, so it must be merged into another genre instead")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "genre successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add a mergeGenreHandler for the "POST /v1/genres/:slug/merge" endpoint, which merges a
+// duplicate genre into the genre named by "into". Unlike deleting, this works for
+// genres which are used by books, as the books are moved to the other genre. The slug
+// of the merged genre is kept as an alias of the other genre, which is returned.
+func (app *application) mergeGenreHandler(w http.ResponseWriter, r *http.Request) {
+	source := readSlugParam(r)
+
+	var input struct {
+		Into string `json:"into"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	taxonomy, err := app.models.Genres.WithContext(r.Context()).Taxonomy()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if taxonomy.Get(source) == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	// The target can be given by its name or one of its aliases, like a book's genres.
+	target, ok := taxonomy.Resolve(input.Into)
+
+	v.Check(input.Into != "", "into", "must be provided")
+	v.Check(input.Into == "" || ok, "into", "must be an existing genre")
+	v.Check(!ok || target != source, "into", "must not be the genre itself")
+
+	// The sub-genres of the merged genre are moved under the target, which would
+	// create a loop if the target was one of them.
+	v.Check(!ok || !taxonomy.IsAncestor(source, target), "into", "must not be one of the genre's sub-genres")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Genres.WithContext(r.Context()).Merge(source, target, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateGenre):
+			v.AddError("into", "already has an alias matching the genre's slug")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	genre, err := app.models.Genres.WithContext(r.Context()).Get(target)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"genre": genre}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The validateGenreTaxonomy() function checks a genre against the rest of the taxonomy.
+// The parent must exist (and its ID is filled in), and none of the aliases can already
+// refer to a different genre.
+func validateGenreTaxonomy(v *validator.Validator, taxonomy *data.Taxonomy, genre *data.Genre) {
+	genre.ParentID = 0
+
+	if genre.Parent != "" {
+		parent := taxonomy.Get(genre.Parent)
+		if parent == nil {
+			v.AddError("parent", "must be an existing genre")
+		} else {
+			genre.ParentID = parent.ID
+		}
+	}
+
+	for _, alias := range genre.Aliases {
+		if existing, ok := taxonomy.Resolve(alias); ok && existing != genre.Slug {
+			v.AddError("aliases", fmt.Sprintf("contains %q, which is already used by the genre %q", alias, existing))
+		}
+	}
+}
+
+// Retrieve the "slug" URL parameter from the current request context.
+func readSlugParam(r *http.Request) string {
+	return data.Slugify(httprouter.ParamsFromContext(r.Context()).ByName("slug"))
+}
+
+// The slugifyAll() function returns the slugs of a list of names.
+func slugifyAll(names []string) []string {
+	slugs := make([]string, len(names))
+	for i, name := range names {
+		slugs[i] = data.Slugify(name)
+	}
+	return slugs
+}
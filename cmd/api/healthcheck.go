@@ -1,18 +1,36 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"time"
+
+	"bookworm.onatim.com/internal/jsonlog"
 )
 
-// A handler which returns a response with information about the
-// application status, operating environment and version.
+// A handler which returns a response with information about the application status,
+// operating environment and version. Like the liveness check it doesn't look at any
+// dependencies, so it's cheap enough to leave public and always reports "available".
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
 	env := envelope{
-		"status": "available",
-		"system_info": map[string]string{
-			"environment": app.config.env,
-			"version":     version,
-		},
+		"status":      "available",
+		"system_info": app.systemInfo(),
+	}
+
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The liveHealthcheckHandler() reports that the application is running and able to
+// serve requests at all. It doesn't check any dependencies, so a failing database
+// doesn't cause the process to be restarted when a restart wouldn't help.
+func (app *application) liveHealthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	env := envelope{
+		"status":      "alive",
+		"system_info": app.systemInfo(),
 	}
 
 	err := app.writeJSON(w, http.StatusOK, env, nil)
@@ -20,3 +38,140 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The readyHealthcheckHandler() reports whether the application is ready to take
+// traffic: the database is reachable, the connection pool isn't exhausted, the schema
+// is at the version the code expects and, if enabled, the SMTP server is reachable. If
+// any of these fail, or the server is shutting down, it sends a 503 Service Unavailable
+// response, with the status of each component so it's clear what's wrong. As it queries the
+// database and reports internal details, Caddy blocks it from the public internet, so
+// it's only reachable by load balancers and monitoring on the private network.
+func (app *application) readyHealthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]envelope{
+		"database":   app.checkDatabase(r),
+		"pool":       app.checkPool(),
+		"migrations": app.checkMigrations(r),
+	}
+
+	if app.config.healthcheck.smtp {
+		checks["smtp"] = app.checkSMTP(r)
+	}
+
+	ready := true
+	for _, check := range checks {
+		if check["status"] != "up" {
+			ready = false
+		}
+	}
+
+	status, code := "available", http.StatusOK
+
+	switch {
+	case app.shuttingDown.Load():
+		status, code = "shutting_down", http.StatusServiceUnavailable
+	case !ready:
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+
+	env := envelope{
+		"status":      status,
+		"checks":      checks,
+		"system_info": app.systemInfo(),
+	}
+
+	err := app.writeJSON(w, code, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) systemInfo() map[string]string {
+	return map[string]string{
+		"environment": app.config.env,
+		"version":     version,
+	}
+}
+
+// The checks below return the status of a single component, which is "up" or "down",
+// plus any details that help explain it. The errors themselves are logged rather than
+// included in the response, as they may contain hostnames or credentials.
+func (app *application) checkDatabase(r *http.Request) envelope {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+
+	err := app.models.Health.Ping(ctx)
+	if err != nil {
+		app.logHealthcheckFailure(r, "database", err)
+		return envelope{"status": "down"}
+	}
+
+	return envelope{"status": "up", "latency": time.Since(start).String()}
+}
+
+// The pool is saturated when every connection that it's allowed to open is in use, in
+// which case new queries have to wait for a connection to be released.
+func (app *application) checkPool() envelope {
+	stats := app.models.Health.Stats()
+
+	check := envelope{
+		"status":          "up",
+		"in_use":          stats.InUse,
+		"idle":            stats.Idle,
+		"max_open":        stats.MaxOpenConnections,
+		"wait_count":      stats.WaitCount,
+		"total_wait_time": stats.WaitDuration.String(),
+	}
+
+	if stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections {
+		check["status"] = "down"
+	}
+
+	return check
+}
+
+// The schema is expected to be at the version of the latest migration embedded in the
+// binary.
+func (app *application) checkMigrations(r *http.Request) envelope {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+
+	version, dirty, err := app.migrator.Version(ctx)
+	if err != nil {
+		app.logHealthcheckFailure(r, "migrations", err)
+		return envelope{"status": "down"}
+	}
+
+	check := envelope{
+		"status":   "up",
+		"version":  version,
+		"expected": app.migrator.Latest(),
+		"dirty":    dirty,
+	}
+
+	if dirty || version != app.migrator.Latest() {
+		check["status"] = "down"
+	}
+
+	return check
+}
+
+func (app *application) checkSMTP(r *http.Request) envelope {
+	start := time.Now()
+
+	err := app.mailer.Ping()
+	if err != nil {
+		app.logHealthcheckFailure(r, "smtp", err)
+		return envelope{"status": "down"}
+	}
+
+	return envelope{"status": "up", "latency": time.Since(start).String()}
+}
+
+func (app *application) logHealthcheckFailure(r *http.Request, component string, err error) {
+	app.contextGetLogger(r).Warn(fmt.Sprintf("healthcheck failed: %s", component),
+		jsonlog.String("component", component),
+		jsonlog.Err(err),
+	)
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"bookworm.onatim.com/internal/storage"
 	"bookworm.onatim.com/internal/validator"
 	"github.com/julienschmidt/httprouter"
 )
@@ -207,6 +213,83 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// The readBool() helper reads a string value from the query string and converts it to a
+// boolean before returning. If no matching key could be found it returns the provided
+// default value. If the value couldn't be converted to a boolean, then we record an
+// error message in the provided Validator instance.
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+
+	return b
+}
+
+// The etag() helper returns the value of the ETag header for a given version of a
+// resource. Weak ETags are used for partial representations (such as when the client
+// asked for specific fields), which can't be used with If-Match.
+func etag(version int32, weak bool) string {
+	tag := strconv.Quote(strconv.Itoa(int(version)))
+	if weak {
+		return "W/" + tag
+	}
+	return tag
+}
+
+// The etagMatches() helper reports whether an If-Match or If-None-Match header value
+// (which may be "*" or a comma-separated list of ETags) matches the given ETag. When
+// strong is true, weak ETags never match, as required for If-Match.
+func etagMatches(header string, tag string, strong bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" {
+			return true
+		}
+
+		if strong {
+			if !strings.HasPrefix(candidate, "W/") && !strings.HasPrefix(tag, "W/") && candidate == tag {
+				return true
+			}
+			continue
+		}
+
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The notModified() helper checks the If-None-Match and If-Modified-Since headers of a
+// GET request against the current ETag and last modified time of a resource. If the
+// client's cached copy is still fresh, it returns true. As per RFC 9110,
+// If-Modified-Since is ignored when If-None-Match is present.
+func (app *application) notModified(r *http.Request, tag string, lastModified time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		return etagMatches(header, tag, false)
+	}
+
+	if header := r.Header.Get("If-Modified-Since"); header != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(header)
+		if err != nil {
+			return false
+		}
+		return !lastModified.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
 // The background() helper accepts an arbitrary function as a parameter.
 func (app *application) background(fn func()) {
 	// Increment the WaitGroup counter.
@@ -228,3 +311,134 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// The randomName() helper returns a random hex-encoded string, for use in the storage
+// keys of uploaded files.
+func randomName() (string, error) {
+	b := make([]byte, 8)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// The newRequestID() helper returns a random hex-encoded ID for a request which didn't
+// come with one.
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// The validRequestID() helper reports whether a request ID sent by a client is safe to
+// use. Since it's echoed back in a header and written to the logs, it's limited to 128
+// letters, digits and a few punctuation characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// The deleteObjects() helper deletes objects from storage. Errors are logged rather
+// than returned, as it's only used once the objects are no longer referenced from the
+// database, so there's nothing more the client could do about it.
+func (app *application) deleteObjects(keys ...string) {
+	for _, key := range keys {
+		err := app.storage.Delete(context.Background(), key)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			app.logger.PrintError(err, map[string]string{"key": key})
+		}
+	}
+}
+
+// The clientIP() function works out the IP address of the client which made a request.
+// The X-Forwarded-For and X-Real-IP headers can be set by anyone, so they're only
+// believed when the request came from one of the trusted proxies. In that case we walk
+// the X-Forwarded-For list from right to left, skipping over the trusted proxies, and
+// the first address which isn't a trusted proxy is the client. Otherwise the client is
+// the address that the request came from.
+func clientIP(r *http.Request, trustedProxies []netip.Prefix) string {
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	client := remote.Addr().Unmap()
+	if !isTrustedProxy(client, trustedProxies) {
+		return client.String()
+	}
+
+	// Each proxy appends the address it received the request from, and there may be
+	// more than one X-Forwarded-For header, so join them all up in order.
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	if len(hops) == 0 {
+		hops = r.Header.Values("X-Real-IP")
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := parseHop(hops[i])
+		if err != nil {
+			// A malformed address must have come from the client (or a proxy that
+			// we don't trust), so use the last good address we found.
+			break
+		}
+
+		client = addr
+		if !isTrustedProxy(client, trustedProxies) {
+			break
+		}
+	}
+
+	return client.String()
+}
+
+// Parse an address from the X-Forwarded-For or X-Real-IP headers, which may include a
+// port number.
+func parseHop(hop string) (netip.Addr, error) {
+	hop = strings.TrimSpace(hop)
+
+	addrPort, err := netip.ParseAddrPort(hop)
+	if err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+
+	addr, err := netip.ParseAddr(hop)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	return addr.Unmap(), nil
+}
+
+// Report whether an address is in one of the trusted proxy ranges.
+func isTrustedProxy(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"bookworm.onatim.com/internal/data"
+)
+
+// How long a stored response is kept for an idempotency key, and the maximum length of
+// a key that clients can send.
+const (
+	idempotencyKeyTTL       = 24 * time.Hour
+	idempotencyKeyMaxLength = 255
+)
+
+// The response headers which are stored along with the body for an idempotency key,
+// and sent again when the response is replayed.
+var idempotencyHeaders = []string{"Content-Type", "Location", "ETag", "Last-Modified"}
+
+// The idempotencyResponseWriter wraps an existing http.ResponseWriter and keeps a copy
+// of the response status code and body, so that the response can be stored against an
+// idempotency key once the handler has finished.
+type idempotencyResponseWriter struct {
+	wrapped       http.ResponseWriter
+	statusCode    int
+	headerWritten bool
+	body          bytes.Buffer
+}
+
+func (iw *idempotencyResponseWriter) Header() http.Header {
+	return iw.wrapped.Header()
+}
+
+func (iw *idempotencyResponseWriter) WriteHeader(statusCode int) {
+	iw.wrapped.WriteHeader(statusCode)
+	if !iw.headerWritten {
+		iw.statusCode = statusCode
+		iw.headerWritten = true
+	}
+}
+
+func (iw *idempotencyResponseWriter) Write(b []byte) (int, error) {
+	if !iw.headerWritten {
+		iw.statusCode = http.StatusOK
+		iw.headerWritten = true
+	}
+	iw.body.Write(b)
+	return iw.wrapped.Write(b)
+}
+
+func (iw *idempotencyResponseWriter) Unwrap() http.ResponseWriter {
+	return iw.wrapped
+}
+
+// The idempotent() middleware lets clients safely retry POST requests by sending an
+// Idempotency-Key header. The response to the first request made with a key is stored,
+// and any retry with the same key and the same payload gets that response replayed
+// instead of being processed again. Keys are scoped to the authenticated user, or to the
+// client IP address for anonymous users, and expire after idempotencyKeyTTL. Requests
+// without the header are passed straight through.
+func (app *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > idempotencyKeyMaxLength {
+			app.badRequestResponse(w, r, fmt.Errorf("Idempotency-Key header must not be more than %d bytes long", idempotencyKeyMaxLength))
+			return
+		}
+
+		// Read the request body so that we can hash it, then replace it with a new
+		// reader so that the handler can read it as normal. The hash also covers the
+		// method, path and query string, so a key can't be reused across endpoints or
+		// with different options. We use an HMAC keyed with a server secret rather than
+		// a plain hash, as the body may contain a password, and a plain hash stored in
+		// the database could be used to check guesses at it far faster than bcrypt.
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			switch {
+			case errors.As(err, &maxBytesError):
+				app.badRequestResponse(w, r, fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit))
+			default:
+				app.badRequestResponse(w, r, err)
+			}
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		mac := hmac.New(sha256.New, app.config.idempotency.secret)
+		mac.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+		mac.Write(body)
+		requestHash := mac.Sum(nil)
+
+		// Anonymous users all have the user ID 0, so scope their keys to the client's
+		// IP address as well, to stop one client from replaying another's response.
+		user := app.contextGetUser(r)
+		userID := user.ID
+
+		if user.IsAnonymous() {
+			key = app.contextGetClientIP(r) + " " + key
+		}
+
+		reserved, record, err := app.models.Idempotency.Reserve(userID, key, requestHash, idempotencyKeyTTL)
+		if err != nil {
+			switch {
+			// The existing record was deleted between trying to reserve the key and
+			// reading it back, so treat it as a request that is still in progress.
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.idempotencyConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !reserved {
+			switch {
+			case subtle.ConstantTimeCompare(record.RequestHash, requestHash) != 1:
+				app.errorResponse(w, r, http.StatusUnprocessableEntity, "the Idempotency-Key header has already been used with a different request")
+			case record.StatusCode == 0:
+				app.idempotencyConflictResponse(w, r)
+			default:
+				for _, name := range idempotencyHeaders {
+					if values, ok := record.Header[name]; ok {
+						w.Header()[name] = values
+					}
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(record.StatusCode)
+				w.Write(record.Body)
+			}
+			return
+		}
+
+		iw := &idempotencyResponseWriter{wrapped: w}
+
+		// If the handler panics, or doesn't store a response below, release the key so
+		// that the request can be retried.
+		completed := false
+		defer func() {
+			if !completed {
+				err := app.models.Idempotency.Release(userID, key)
+				if err != nil {
+					app.logError(r, err)
+				}
+			}
+		}()
+
+		next.ServeHTTP(iw, r)
+
+		// Don't store server errors, as retrying the request may well succeed.
+		if iw.statusCode >= 500 {
+			return
+		}
+
+		header := make(map[string][]string)
+		for _, name := range idempotencyHeaders {
+			if values, ok := iw.Header()[name]; ok {
+				header[name] = values
+			}
+		}
+
+		err = app.models.Idempotency.Complete(userID, key, iw.statusCode, header, iw.body.Bytes())
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+
+		completed = true
+	}
+}
+
+// The purgeIdempotencyKeys() method starts a background goroutine which deletes expired
+// idempotency keys. Like purgeTrash(), it runs once at startup and then every hour,
+// until the done channel is closed.
+func (app *application) purgeIdempotencyKeys(done <-chan struct{}) {
+	app.background(func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			purged, err := app.models.Idempotency.DeleteExpired()
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			} else if purged > 0 {
+				app.logger.PrintInfo("purged expired idempotency keys", map[string]string{
+					"count": strconv.FormatInt(purged, 10),
+				})
+			}
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"bookworm.onatim.com/internal/data"
+	"bookworm.onatim.com/internal/validator"
+)
+
+// Limits for the "POST /v1/books/import" endpoint. The body limit is much larger than
+// the 1MB used by readJSON(), as an import may contain thousands of books.
+const (
+	maxImportBytes = 10_485_760
+	maxImportRows  = 10_000
+)
+
+// An importRow holds a book read from an import file, along with the line number it
+// was read from and any errors we found with it.
+type importRow struct {
+	line   int
+	book   *data.Book
+	errors map[string]string
+}
+
+// Add an importBooksHandler for the "POST /v1/books/import" endpoint. This accepts a
+// CSV or NDJSON request body containing many books, validates every row and inserts
+// the valid ones. Invalid rows don't stop the import; instead they are reported back to
+// the client keyed by their line number.
+func (app *application) importBooksHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		DryRun     bool
+		OnConflict string
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	// When dry_run is true we report what the import would do without saving anything.
+	// The on_conflict value decides what happens to books with the same ISBN as an
+	// existing record.
+	input.DryRun = app.readBool(qs, "dry_run", false, v)
+	input.OnConflict = app.readString(qs, "on_conflict", data.OnConflictError)
+
+	v.Check(validator.PermittedValue(input.OnConflict, data.OnConflictError, data.OnConflictSkip, data.OnConflictUpdate), "on_conflict", "must be error, skip or update")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Use http.MaxBytesReader() to limit the size of the request body, then pick the
+	// parser based on the Content-Type header.
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var rows []*importRow
+	var err error
+
+	switch mediaType {
+	case "text/csv":
+		rows, err = readImportCSV(r.Body)
+	case "application/x-ndjson", "application/jsonl":
+		rows, err = readImportNDJSON(r.Body)
+	default:
+		app.unsupportedMediaTypeResponse(w, r, "text/csv", "application/x-ndjson")
+		return
+	}
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// Load the genre taxonomy to check the book's genres against.
+	taxonomy, err := app.models.Genres.WithContext(r.Context()).Taxonomy()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Validate each of the rows which we were able to parse, collecting the valid
+	// books to be imported.
+	var books []*data.Book
+	var valid []*importRow
+
+	for _, row := range rows {
+		if row.errors != nil {
+			continue
+		}
+
+		v := validator.New()
+
+		if data.ValidateBook(v, row.book, taxonomy); !v.Valid() {
+			row.errors = v.Errors
+			continue
+		}
+
+		books = append(books, row.book)
+		valid = append(valid, row)
+	}
+
+	outcomes, err := app.models.Books.WithContext(r.Context()).Import(books, input.OnConflict, input.DryRun, app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Tally up the outcomes and build the per-row error report.
+	counts := map[string]int{
+		data.ImportCreated: 0,
+		data.ImportUpdated: 0,
+		data.ImportSkipped: 0,
+	}
+
+	for i, outcome := range outcomes {
+		if outcome == data.ImportConflict {
+			valid[i].errors = map[string]string{"ISBN": "a book with this ISBN already exists"}
+			continue
+		}
+		counts[outcome]++
+	}
+
+	rowErrors := make(map[int]map[string]string)
+	for _, row := range rows {
+		if row.errors != nil {
+			rowErrors[row.line] = row.errors
+		}
+	}
+
+	report := envelope{
+		"dry_run": input.DryRun,
+		"total":   len(rows),
+		"created": counts[data.ImportCreated],
+		"updated": counts[data.ImportUpdated],
+		"skipped": counts[data.ImportSkipped],
+		"failed":  len(rowErrors),
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"import": report, "errors": rowErrors}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readImportCSV() function reads books from a CSV file. The first record must be a
+// header naming the columns, which can be any of title, year, isbn and genres in any
+// order. Multiple genres are separated by commas within a single (quoted) field, in
+// the same way as the genres query string parameter. The id and version columns
+// written by the export endpoint are accepted but ignored.
+func readImportCSV(body io.Reader) ([]*importRow, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, importReadError(err)
+	}
+
+	for i, column := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(column))
+		if !validator.PermittedValue(header[i], "id", "title", "year", "isbn", "genres", "version") {
+			return nil, fmt.Errorf("body contains unknown CSV column %q", column)
+		}
+	}
+
+	var rows []*importRow
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		// A *csv.ParseError only affects the current record, so we report it against
+		// that line and carry on reading. Any other error means the body couldn't be
+		// read at all.
+		var parseError *csv.ParseError
+		if errors.As(err, &parseError) {
+			rows = append(rows, &importRow{
+				line:   parseError.StartLine,
+				errors: map[string]string{"row": parseError.Err.Error()},
+			})
+			continue
+		}
+		if err != nil {
+			return nil, importReadError(err)
+		}
+
+		line, _ := reader.FieldPos(0)
+		row := &importRow{line: line, book: &data.Book{}}
+
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+
+			switch header[i] {
+			case "title":
+				row.book.Title = value
+			case "year":
+				year, err := strconv.ParseInt(value, 10, 32)
+				if err != nil {
+					row.addError("year", "must be an integer value")
+				}
+				row.book.Year = int32(year)
+			case "isbn":
+				isbn, err := data.ParseISBN(value)
+				if err != nil {
+					row.addError("ISBN", err.Error())
+				}
+				row.book.ISBN = isbn
+			case "genres":
+				if value != "" {
+					row.book.Genres = strings.Split(value, ",")
+					for j := range row.book.Genres {
+						row.book.Genres[j] = strings.TrimSpace(row.book.Genres[j])
+					}
+				}
+			}
+		}
+
+		rows = append(rows, row)
+
+		if len(rows) > maxImportRows {
+			return nil, fmt.Errorf("body must not contain more than %d rows", maxImportRows)
+		}
+	}
+
+	return rows, nil
+}
+
+// The readImportNDJSON() function reads books from a newline-delimited JSON body, where
+// each non-blank line is a JSON object with the same keys accepted by the
+// "POST /v1/books" endpoint.
+func readImportNDJSON(body io.Reader) ([]*importRow, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1_048_576)
+
+	var rows []*importRow
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var input struct {
+			Title  string    `json:"title"`
+			Year   int32     `json:"year"`
+			ISBN   data.ISBN `json:"ISBN"`
+			Genres []string  `json:"genres"`
+		}
+
+		row := &importRow{line: line}
+
+		dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		dec.DisallowUnknownFields()
+
+		err := dec.Decode(&input)
+		if err != nil {
+			row.addError("row", err.Error())
+		} else {
+			row.book = &data.Book{
+				Title:  input.Title,
+				Year:   input.Year,
+				ISBN:   input.ISBN,
+				Genres: input.Genres,
+			}
+		}
+
+		rows = append(rows, row)
+
+		if len(rows) > maxImportRows {
+			return nil, fmt.Errorf("body must not contain more than %d rows", maxImportRows)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, importReadError(err)
+	}
+
+	return rows, nil
+}
+
+// Add an error message for a row (so long as no entry already exists for the key).
+func (row *importRow) addError(key, message string) {
+	if row.errors == nil {
+		row.errors = make(map[string]string)
+	}
+	if _, exists := row.errors[key]; !exists {
+		row.errors[key] = message
+	}
+}
+
+// Convert an error from reading the import body into a plain-english message for the
+// client.
+func importReadError(err error) error {
+	var maxBytesError *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &maxBytesError):
+		return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+	case errors.Is(err, bufio.ErrTooLong):
+		return errors.New("body contains a line longer than 1048576 bytes")
+	case errors.Is(err, io.EOF):
+		return errors.New("body must not be empty")
+	default:
+		return err
+	}
+}
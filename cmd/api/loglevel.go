@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+
+	"bookworm.onatim.com/internal/jsonlog"
+	"bookworm.onatim.com/internal/validator"
+)
+
+// The showLogLevelHandler() returns the logger's current minimum level. Like
+// /debug/vars, it lives under /debug/ so that Caddy keeps it off the public internet.
+func (app *application) showLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"level": app.logger.Level()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateLogLevelHandler() changes the logger's minimum level while the application
+// is running, for example to turn on debug logging while investigating a problem. The
+// change isn't persisted, so the level from the -log-level flag is used again after a
+// restart. Caddy blocks /debug/ from the public internet, but the API listens on every
+// interface, so changing the level also needs the admin:write permission.
+func (app *application) updateLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Level *string `json:"level"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	var level jsonlog.Level
+
+	v.Check(input.Level != nil, "level", "must be provided")
+	if input.Level != nil {
+		level, err = jsonlog.ParseLevel(*input.Level)
+		v.Check(err == nil, "level", "must be one of debug, info, warn, error, fatal or off")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	previous := app.logger.Level()
+
+	// Log the change at the WARN level, so that it stands out from the usual entries.
+	// When the level is being raised, say to ERROR, the entry would be dropped once the
+	// new level is set, so it's logged before the change rather than after.
+	logChange := func() {
+		app.contextGetLogger(r).Warn("log level changed",
+			jsonlog.String("previous", previous.String()),
+			jsonlog.String("level", level.String()),
+			jsonlog.Int64("user_id", app.contextGetUser(r).ID),
+		)
+	}
+
+	if level > previous {
+		logChange()
+		app.logger.SetLevel(level)
+	} else {
+		app.logger.SetLevel(level)
+		logChange()
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"level": level}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
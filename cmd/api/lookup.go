@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+
+	"bookworm.onatim.com/internal/data"
+	"bookworm.onatim.com/internal/metadata"
+	"bookworm.onatim.com/internal/validator"
+)
+
+// The maximum number of genres a book can have, which limits how many of the subjects
+// from the metadata provider are used.
+const maxBookGenres = 5
+
+// Add a lookupBookHandler for the "POST /v1/books/lookup" endpoint. This looks the ISBN
+// up with the metadata provider and returns a draft book, which the client can check
+// and then send to "POST /v1/books". The full record from the provider is included too,
+// as it has details such as the authors which aren't part of a book. The ISBN is read as
+// a string, rather than a data.ISBN, so that ISBN-13s and ISBN-10s with leading zeros or
+// an X check digit can be looked up too.
+func (app *application) lookupBookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ISBN string `json:"ISBN"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	isbn, ok := metadata.CleanISBN(input.ISBN)
+
+	v.Check(input.ISBN != "", "ISBN", "must be provided")
+	v.Check(ok, "ISBN", "must be a valid ISBN-10 or ISBN-13")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	record, err := app.lookupMetadata(r.Context(), isbn)
+	if err != nil {
+		switch {
+		case errors.Is(err, metadata.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.badGatewayResponse(w, r, err)
+		}
+		return
+	}
+
+	taxonomy, err := app.models.Genres.WithContext(r.Context()).Taxonomy()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	book := &data.Book{}
+	fillFromMetadata(book, record, taxonomy)
+
+	// The draft hasn't been saved, so only send the fields which can be sent to
+	// "POST /v1/books". Books can't be saved with every ISBN that can be looked up, so
+	// the ISBN is only included if it fits.
+	fields := []string{"title", "year", "genres"}
+
+	if parsed, err := data.ParseISBN(isbn); err == nil && parsed > 0 {
+		book.ISBN = parsed
+		fields = append(fields, "ISBN")
+	}
+
+	draft := book.Project(data.Fieldset{Fields: fields})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": draft, "metadata": record}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The lookupMetadata() helper looks an ISBN up with the metadata provider. If no
+// provider is configured, it returns metadata.ErrNotFound.
+func (app *application) lookupMetadata(ctx context.Context, isbn string) (*metadata.Record, error) {
+	if app.metadata == nil {
+		return nil, metadata.ErrNotFound
+	}
+
+	return app.metadata.Lookup(ctx, isbn)
+}
+
+// The fillFromMetadata() function copies the details from a metadata record into any
+// fields of the book which haven't been set. The record's subjects are used as the
+// genres, keeping only those which are in the genre taxonomy.
+func fillFromMetadata(book *data.Book, record *metadata.Record, taxonomy *data.Taxonomy) {
+	if book.Title == "" {
+		book.Title = record.Title
+	}
+
+	if book.Year == 0 {
+		book.Year = record.Year
+	}
+
+	if book.Genres == nil {
+		genres := []string{}
+
+		for _, subject := range record.Subjects {
+			genre, ok := taxonomy.Resolve(subject)
+			if ok && !validator.PermittedValue(genre, genres...) {
+				genres = append(genres, genre)
+			}
+			if len(genres) == maxBookGenres {
+				break
+			}
+		}
+
+		book.Genres = genres
+	}
+}
+
+// A metadataCover holds a cover image downloaded from the metadata provider, which has
+// been checked by decodeCover().
+type metadataCover struct {
+	body []byte
+	img  image.Image
+	ext  string
+}
+
+// The fetchCover() helper downloads the cover image of a metadata record, and checks
+// that it can be used as a book's cover.
+func (app *application) fetchCover(ctx context.Context, coverURL string) (*metadataCover, error) {
+	body, err := app.metadata.Cover(ctx, coverURL, maxCoverBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	img, ext, err := decodeCover(body)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: invalid cover image: %w", err)
+	}
+
+	return &metadataCover{body: body, img: img, ext: ext}, nil
+}
+
+// The attachCover() helper stores a cover from the metadata provider and sets it as the
+// cover of a newly created book. By this point the book has been created, so failing the
+// request would just invite the client to create it again. Instead any error is logged
+// and the book is left without a cover, which can still be uploaded separately.
+func (app *application) attachCover(r *http.Request, book *data.Book, cover *metadataCover) {
+	stored, err := app.storeCover(r.Context(), book.ID, cover.body, cover.img, cover.ext)
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+
+	err = app.models.Books.WithContext(r.Context()).SetCover(book, stored)
+	if err != nil {
+		app.deleteObjects(stored.Keys()...)
+		app.logError(r, err)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"bookworm.onatim.com/internal/metadata"
+)
+
+// The genre taxonomy used by the tests: fiction, with fantasy as a subgenre.
+func withTaxonomy(db *fakeDB) {
+	db.on("FROM genres", []string{"id", "slug", "name", "parent_id", "aliases"},
+		[]driver.Value{int64(1), "fiction", "Fiction", int64(0), []byte("{}")},
+		[]driver.Value{int64(2), "fantasy", "Fantasy", int64(1), []byte("{sword-and-sorcery}")},
+	)
+}
+
+func TestLookupBookNotFound(t *testing.T) {
+	db := &fakeDB{}
+	app := newTestApplication(t, db, metadata.NewFake(nil))
+
+	rr := httptest.NewRecorder()
+	app.lookupBookHandler(rr, newTestRequest(t, http.MethodPost, "/v1/books/lookup", map[string]string{"ISBN": "0-306-40615-2"}))
+
+	decodeResponse(t, rr, http.StatusNotFound)
+
+	if db.ran("FROM genres") {
+		t.Error("taxonomy was loaded for an ISBN which wasn't found")
+	}
+}
+
+func TestLookupBookPartialRecord(t *testing.T) {
+	db := &fakeDB{}
+	withTaxonomy(db)
+
+	provider := metadata.NewFake(map[string]*metadata.Record{
+		"0306406152": {Title: "The Name of the Wind", Subjects: []string{"Sword and sorcery", "Juvenile literature", "Fiction"}},
+	})
+	app := newTestApplication(t, db, provider)
+
+	rr := httptest.NewRecorder()
+	app.lookupBookHandler(rr, newTestRequest(t, http.MethodPost, "/v1/books/lookup", map[string]string{"ISBN": "0-306-40615-2"}))
+
+	body := decodeResponse(t, rr, http.StatusOK)
+
+	var draft map[string]any
+	if err := json.Unmarshal(body["book"], &draft); err != nil {
+		t.Fatal(err)
+	}
+
+	if draft["title"] != "The Name of the Wind" {
+		t.Errorf("got title %v; want %q", draft["title"], "The Name of the Wind")
+	}
+
+	// The record has no year, so the draft's year is left for the client to fill in.
+	if year, _ := draft["year"].(float64); year != 0 {
+		t.Errorf("got year %v; want none", draft["year"])
+	}
+
+	// Subjects which aren't in the taxonomy are dropped, and aliases are resolved.
+	var genres []string
+	for _, genre := range draft["genres"].([]any) {
+		genres = append(genres, genre.(string))
+	}
+	if want := []string{"fantasy", "fiction"}; !slices.Equal(genres, want) {
+		t.Errorf("got genres %v; want %v", genres, want)
+	}
+
+	if _, ok := draft["cover_url"]; ok {
+		t.Error("draft has a cover_url")
+	}
+}
+
+func TestCreateBookWithMetadataCover(t *testing.T) {
+	const coverURL = "https://covers.example.com/b/isbn/0306406152-L.jpg"
+
+	var cover bytes.Buffer
+	if err := png.Encode(&cover, image.NewRGBA(image.Rect(0, 0, 600, 900))); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := metadata.NewFake(map[string]*metadata.Record{
+		"0306406152": {Title: "The Name of the Wind", Year: 2007, Subjects: []string{"Fantasy"}, CoverURL: coverURL},
+	})
+	provider.AddCover(coverURL, cover.Bytes())
+
+	now := time.Now()
+
+	db := &fakeDB{}
+	withTaxonomy(db)
+	db.on("INSERT INTO books", []string{"id", "created_at", "updated_at", "version"},
+		[]driver.Value{int64(7), now, now, int64(1)})
+	db.on("INSERT INTO book_revisions", nil)
+	db.on("SET cover", []string{"updated_at", "version"},
+		[]driver.Value{now, int64(2)})
+
+	app := newTestApplication(t, db, provider)
+
+	rr := httptest.NewRecorder()
+	app.createBookHandler(rr, newTestRequest(t, http.MethodPost, "/v1/books?enrich=true", map[string]string{"ISBN": "0-306-40615-2"}))
+
+	body := decodeResponse(t, rr, http.StatusCreated)
+
+	var book struct {
+		Title    string   `json:"title"`
+		Year     int32    `json:"year"`
+		Genres   []string `json:"genres"`
+		Version  int32    `json:"version"`
+		CoverURL string   `json:"cover_url"`
+	}
+	if err := json.Unmarshal(body["book"], &book); err != nil {
+		t.Fatal(err)
+	}
+
+	if book.Title != "The Name of the Wind" || book.Year != 2007 || !slices.Equal(book.Genres, []string{"fantasy"}) {
+		t.Errorf("book wasn't filled in from the record: %+v", book)
+	}
+	if book.Version != 2 {
+		t.Errorf("got version %d; want 2", book.Version)
+	}
+	if !strings.Contains(book.CoverURL, "covers/7/") || !strings.HasSuffix(book.CoverURL, ".png") {
+		t.Fatalf("got cover_url %q; want a PNG cover for book 7", book.CoverURL)
+	}
+
+	// The original image should have been stored unchanged.
+	key := book.CoverURL[strings.Index(book.CoverURL, "covers/"):]
+
+	f, err := app.storage.Open(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	stored, _, err := image.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stored.Bounds().Size(); got != image.Pt(600, 900) {
+		t.Errorf("got stored cover of size %v; want 600x900", got)
+	}
+}
+
+func TestCreateBookWithInvalidMetadataCover(t *testing.T) {
+	provider := metadata.NewFake(map[string]*metadata.Record{
+		"0306406152": {Title: "The Name of the Wind", Year: 2007, Subjects: []string{"Fantasy"}, CoverURL: "https://covers.example.com/broken.jpg"},
+	})
+	provider.AddCover("https://covers.example.com/broken.jpg", []byte("not an image"))
+
+	db := &fakeDB{}
+	withTaxonomy(db)
+
+	app := newTestApplication(t, db, provider)
+
+	rr := httptest.NewRecorder()
+	app.createBookHandler(rr, newTestRequest(t, http.MethodPost, "/v1/books?enrich=true", map[string]string{"ISBN": "0-306-40615-2"}))
+
+	decodeResponse(t, rr, http.StatusBadGateway)
+
+	if db.ran("INSERT INTO books") {
+		t.Error("book was created even though its cover couldn't be used")
+	}
+}
@@ -2,20 +2,34 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
+	"log/slog"
+	"net/netip"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"bookworm.onatim.com/internal/data"
 	"bookworm.onatim.com/internal/jsonlog"
 	"bookworm.onatim.com/internal/mailer"
+	"bookworm.onatim.com/internal/metadata"
+	"bookworm.onatim.com/internal/metrics"
+	"bookworm.onatim.com/internal/migrate"
+	"bookworm.onatim.com/internal/ratelimit"
+	"bookworm.onatim.com/internal/storage"
+	"bookworm.onatim.com/internal/tracing"
+	"bookworm.onatim.com/internal/validator"
 	"bookworm.onatim.com/internal/vcs"
+	"bookworm.onatim.com/migrations"
 	_ "github.com/lib/pq"
 )
 
@@ -25,7 +39,8 @@ var (
 )
 
 // Define a config struct to hold all the configuration settings for our application.
-// We will read in these configuration settings from command-line flags when the application starts.
+// We will read in these configuration settings from command-line flags when the application starts,
+// along with a configuration file and environment variables (see config.go).
 type config struct {
 	port int
 	env  string
@@ -34,11 +49,20 @@ type config struct {
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
+		autoMigrate  bool
+	}
+	log struct {
+		level jsonlog.Level
 	}
 	limiter struct {
 		enabled bool
 		rps     float64
 		burst   int
+		user    ratelimit.Rate
+		auth    ratelimit.Rate
+		ip      ratelimit.Rate
+		tiers   map[string]ratelimit.Rate
+		store   string
 	}
 	smtp struct {
 		host     string
@@ -50,16 +74,67 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	proxies struct {
+		trusted []netip.Prefix
+	}
+	cursor struct {
+		secret []byte
+	}
+	trash struct {
+		retention time.Duration
+	}
+	recommendations struct {
+		interval time.Duration
+	}
+	tracing struct {
+		endpoint    string
+		sampleRatio float64
+	}
+	accessLog struct {
+		enabled  bool
+		sampling map[string]float64
+	}
+	healthcheck struct {
+		smtp bool
+	}
+	shutdown struct {
+		drain time.Duration
+	}
+	storage struct {
+		dir string
+	}
+	download struct {
+		secret []byte
+	}
+	idempotency struct {
+		secret []byte
+	}
+	metadata struct {
+		provider string
+		url      string
+		timeout  time.Duration
+		enrich   bool
+	}
 }
 
 // Define an application struct to hold the dependencies for our HTTP handlers,
 // helpers, and middleware
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config   config
+	logger   *jsonlog.Logger
+	models   data.Models
+	mailer   mailer.Mailer
+	metadata metadata.Provider
+	limiter  ratelimit.Limiter
+	storage  storage.Storage
+	registry *metrics.Registry
+	tracer   *tracing.Tracer
+	migrator *migrate.Migrator
+	wg       sync.WaitGroup
+
+	// shuttingDown is set once a graceful shutdown has started, so that the readiness
+	// healthcheck can tell load balancers to stop sending new requests.
+	shuttingDown atomic.Bool
 }
 
 func main() {
@@ -69,23 +144,45 @@ func main() {
 	// Read the value of env command-line flags into the config struct.
 	flag.IntVar(&cfg.port, "port", 4000, "API server port")
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	flag.TextVar(&cfg.log.level, "log-level", jsonlog.LevelInfo, "Minimum log level (debug|info|warn|error|fatal|off)")
 
 	flag.StringVar(&cfg.db.dsn, "db-dsn", "", "PostgreSQL DSN")
 
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
+	flag.BoolVar(&cfg.db.autoMigrate, "db-auto-migrate", false, "Apply any pending database migrations on startup")
+
+	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second for anonymous clients")
+	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst for anonymous clients")
+	flag.Float64Var(&cfg.limiter.user.RPS, "limiter-user-rps", 5, "Rate limiter maximum requests per second for authenticated users")
+	flag.IntVar(&cfg.limiter.user.Burst, "limiter-user-burst", 10, "Rate limiter maximum burst for authenticated users")
+	flag.Float64Var(&cfg.limiter.auth.RPS, "limiter-auth-rps", 0.1, "Rate limiter maximum requests per second for logging in and signing up")
+	flag.IntVar(&cfg.limiter.auth.Burst, "limiter-auth-burst", 5, "Rate limiter maximum burst for logging in and signing up")
+	flag.Float64Var(&cfg.limiter.ip.RPS, "limiter-ip-rps", 20, "Rate limiter maximum requests per second from each IP address, authenticated or not")
+	flag.IntVar(&cfg.limiter.ip.Burst, "limiter-ip-burst", 40, "Rate limiter maximum burst from each IP address, authenticated or not")
+
+	// Use flag.Func() to read the rate limiter tiers, which give users with a particular
+	// permission a different rate, in the form "books:write=10:20" (a permission code,
+	// then the requests per second and burst).
+	flag.Func("limiter-tiers", "Rate limiter tiers for users with a permission (space separated permission=rps:burst)", func(val string) error {
+		tiers, err := parseRateTiers(val)
+		cfg.limiter.tiers = tiers
+		return err
+	})
 
-	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
-	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	flag.StringVar(&cfg.limiter.store, "limiter-store", "memory", "Where the rate limiter keeps its counts (memory|postgres)")
 
 	flag.StringVar(&cfg.smtp.host, "smtp-host", "smtp.mailtrap.io", "SMTP host")
 	flag.IntVar(&cfg.smtp.port, "smtp-port", 2525, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", "8afa73271a8d88", "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", "18b7af7ab4afaa", "SMTP password")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "bookworm <from@example.com>", "SMTP sender")
 
+	flag.BoolVar(&cfg.healthcheck.smtp, "healthcheck-smtp", false, "Include the SMTP server in the readiness healthcheck")
+	flag.DurationVar(&cfg.shutdown.drain, "shutdown-drain", 5*time.Second, "How long to keep serving requests after failing the readiness healthcheck during shutdown")
+
 	// Use the flag.Func() function to process the -cors-trusted-origins command line
 	// flag. In this we use the strings.Fields() function to split the flag value into a
 	// slice based on whitespace characters and assign it to our config struct.
@@ -97,6 +194,82 @@ func main() {
 		return nil
 	})
 
+	// Use flag.Func() to read the addresses of the reverse proxies that we trust to set
+	// the X-Forwarded-For and X-Real-IP headers. Single IP addresses are accepted as
+	// well as CIDR ranges. If no proxies are trusted, the headers are ignored.
+	flag.Func("trusted-proxies", "Trusted reverse proxy IP addresses or CIDR ranges (space separated)", func(val string) error {
+		var trusted []netip.Prefix
+
+		for _, field := range strings.Fields(val) {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				addr, addrErr := netip.ParseAddr(field)
+				if addrErr != nil {
+					return fmt.Errorf("invalid trusted proxy %q", field)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			trusted = append(trusted, prefix.Masked())
+		}
+
+		// Replace rather than add to any proxies set before, so that a value from the
+		// configuration file or environment is overridden by the flag.
+		cfg.proxies.trusted = trusted
+		return nil
+	})
+
+	flag.StringVar(&cfg.storage.dir, "storage-dir", "uploads", "Directory to store uploaded files in")
+
+	flag.StringVar(&cfg.metadata.provider, "metadata-provider", "openlibrary", "Book metadata provider (openlibrary|none)")
+	flag.StringVar(&cfg.metadata.url, "metadata-url", "https://openlibrary.org", "Base URL of the book metadata provider")
+	flag.DurationVar(&cfg.metadata.timeout, "metadata-timeout", 5*time.Second, "Timeout for book metadata lookups")
+	flag.BoolVar(&cfg.metadata.enrich, "metadata-enrich", false, "Fill in missing book details from the metadata provider by default when creating books")
+
+	flag.DurationVar(&cfg.trash.retention, "trash-retention", 30*24*time.Hour, "How long deleted books are kept in the trash before being purged")
+
+	flag.DurationVar(&cfg.recommendations.interval, "recommendations-interval", time.Hour, "How often similar books and recommendations are recomputed")
+
+	flag.StringVar(&cfg.tracing.endpoint, "otlp-endpoint", "", "OTLP/HTTP traces endpoint to export spans to, such as http://localhost:4318/v1/traces (disabled if empty)")
+	flag.Float64Var(&cfg.tracing.sampleRatio, "trace-sample-ratio", 1, "Fraction of traces to export, from 0 to 1")
+
+	flag.BoolVar(&cfg.accessLog.enabled, "access-log", true, "Write an access log entry for each request")
+
+	// Use flag.Func() to read the sampling ratios for noisy routes, in the form
+	// "/v1/healthcheck=0.01" (a route pattern, then the fraction of its requests to
+	// log). Routes which aren't listed are always logged.
+	flag.Func("access-log-sample", "Fraction of requests to log for noisy routes (space separated route=ratio)", func(val string) error {
+		sampling, err := parseSampleRatios(val)
+		cfg.accessLog.sampling = sampling
+		return err
+	})
+
+	// Use flag.Func() to read the secret used to sign pagination cursors. If it isn't
+	// provided we generate a random one below, which is fine for a single instance
+	// but means cursors won't survive a restart or work across replicas.
+	flag.Func("cursor-secret", "Secret key for signing pagination cursors", func(val string) error {
+		cfg.cursor.secret = []byte(val)
+		return nil
+	})
+
+	// Likewise for the secret used to sign download URLs.
+	flag.Func("download-secret", "Secret key for signing download URLs", func(val string) error {
+		cfg.download.secret = []byte(val)
+		return nil
+	})
+
+	// And for the secret used to hash request bodies stored with idempotency keys. A
+	// random one means that retries made across a restart are rejected as having a
+	// different payload.
+	flag.Func("idempotency-secret", "Secret key for hashing requests made with an Idempotency-Key", func(val string) error {
+		cfg.idempotency.secret = []byte(val)
+		return nil
+	})
+
+	// Declare the -smtp-password-file flag and the like, for reading secrets from files.
+	registerSecretFileFlags(flag.CommandLine)
+
+	configFile := flag.String("config", "", "Path to a configuration file (overrides the defaults, overridden by BOOKWORM_* environment variables and flags)")
+
 	// Version boolean flag with the default value of false.
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
@@ -109,20 +282,145 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Initialize a new jsonlog.Logger which writes any messages *at or above* the INFO
-	// severity level to the standard out stream.
-	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+	// Fill in any settings which weren't given as flags from the configuration file and
+	// the environment. We don't have a logger yet, as its level is one of the settings,
+	// so report any errors in the same way as the flag package does.
+	err := loadConfig(flag.CommandLine, *configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		os.Exit(2)
+	}
+
+	// Initialize a new jsonlog.Logger which writes any messages *at or above* the
+	// configured severity level to the standard out stream. The level can be changed
+	// while the application is running through the /debug/log-level endpoint. Also make
+	// it the default for log/slog, so that anything logging through slog ends up in
+	// the same place and format.
+	logger := jsonlog.New(os.Stdout, cfg.log.level)
+	slog.SetDefault(slog.New(jsonlog.NewHandler(logger)))
+
+	// Check the settings before using any of them, and report all the problems at once.
+	v := validator.New()
+
+	if validateConfig(v, cfg); !v.Valid() {
+		logger.Fatal(errors.New("invalid configuration"), jsonlog.Any("errors", v.Errors))
+	}
+
+	logger.Info("configuration loaded", configAttrs(cfg)...)
+
+	if len(cfg.cursor.secret) == 0 {
+		cfg.cursor.secret = make([]byte, 32)
+		_, err := rand.Read(cfg.cursor.secret)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Info("generated random pagination cursor secret")
+	}
+
+	if len(cfg.download.secret) == 0 {
+		cfg.download.secret = make([]byte, 32)
+		_, err := rand.Read(cfg.download.secret)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Info("generated random download URL secret")
+	}
+
+	if len(cfg.idempotency.secret) == 0 {
+		cfg.idempotency.secret = make([]byte, 32)
+		_, err := rand.Read(cfg.idempotency.secret)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Info("generated random idempotency key secret")
+	}
 
 	// Call the openDB() helper function (see below) to create the connection pool,
 	// passing in the config struct. If this returns an error, we log it and exit the
 	// application immediately.
 	db, err := openDB(cfg)
 	if err != nil {
-		logger.PrintFatal(err, nil)
+		logger.Fatal(err)
 	}
 	defer db.Close()
 
-	logger.PrintInfo("database connection pool established", nil)
+	logger.Info("database connection pool established")
+
+	// Load the migrations which are embedded in the binary.
+	migrator, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	// If a command was given after the flags, like "api migrate up", run it instead
+	// of starting the server.
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "migrate":
+			err = runMigrate(migrator, logger, flag.Args()[1:])
+		default:
+			err = fmt.Errorf("unknown command %q", flag.Arg(0))
+		}
+		if err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+
+	// Apply any pending migrations before serving requests, if enabled. The migrator
+	// takes a lock, so it's safe for several instances to start at the same time.
+	if cfg.db.autoMigrate {
+		applied, err := migrator.Up(context.Background())
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Info("database migrations applied", jsonlog.Int("count", len(applied)), jsonlog.Int64("version", migrator.Latest()))
+	}
+
+	// Open the storage for uploaded files, creating its directory if necessary.
+	store, err := storage.NewLocal(cfg.storage.dir)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	// Set up the metadata provider, if one is enabled.
+	var provider metadata.Provider
+
+	switch cfg.metadata.provider {
+	case "openlibrary":
+		provider = metadata.NewOpenLibrary(cfg.metadata.url, cfg.metadata.timeout)
+	case "none":
+	default:
+		logger.Fatal(fmt.Errorf("invalid metadata provider %q", cfg.metadata.provider))
+	}
+
+	// Set up the rate limiter. The in-memory limiter is the fastest, but when running
+	// more than one instance of the API the postgres limiter should be used, so that
+	// they share the same limits.
+	var limiter ratelimit.Limiter
+
+	switch cfg.limiter.store {
+	case "memory":
+		limiter = ratelimit.NewMemory()
+	case "postgres":
+		limiter = ratelimit.NewPostgres(db)
+	default:
+		logger.Fatal(fmt.Errorf("invalid rate limiter store %q", cfg.limiter.store))
+	}
+
+	// Set up the tracer. Without an exporter, requests still get trace IDs for the logs
+	// and error responses, but spans aren't sent anywhere.
+	var exporter tracing.Exporter
+	if cfg.tracing.endpoint != "" {
+		exporter = tracing.NewOTLPExporter(cfg.tracing.endpoint, "bookworm", version, nil)
+	}
+
+	tracer := tracing.NewTracer(exporter, tracing.Options{
+		SampleRatio: cfg.tracing.sampleRatio,
+		ErrorLog: func(err error) {
+			logger.Error(err, jsonlog.String("component", "tracing"))
+		},
+	})
 
 	// Publish a "version" variable in the expvar handler containing
 	// our application version number.
@@ -143,18 +441,31 @@ func main() {
 		return time.Now().Unix()
 	}))
 
+	// Create the registry for the Prometheus metrics served at /metrics. The request
+	// metrics are added by the metrics middleware, and the database connection pool
+	// and Go runtime statistics are read each time the metrics are scraped.
+	registry := metrics.NewRegistry()
+	registry.RegisterDBStats("bookworm_db", db.Stats)
+	registry.RegisterRuntimeStats()
+
 	// Declare an instance of the application struct
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:   cfg,
+		logger:   logger,
+		models:   data.NewModels(db),
+		mailer:   mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		metadata: provider,
+		limiter:  limiter,
+		storage:  store,
+		registry: registry,
+		tracer:   tracer,
+		migrator: migrator,
 	}
 
 	// Call app.serve() to start the server.
 	err = app.serve()
 	if err != nil {
-		logger.PrintFatal(err, nil)
+		logger.Fatal(err)
 	}
 }
 
@@ -201,3 +512,48 @@ func openDB(cfg config) (*sql.DB, error) {
 	// Return the sql.DB connection pool
 	return db, nil
 }
+
+// The parseRateTiers() function parses the value of the -limiter-tiers flag, which is a
+// space separated list of tiers in the form "permission=rps:burst".
+func parseRateTiers(val string) (map[string]ratelimit.Rate, error) {
+	tiers := make(map[string]ratelimit.Rate)
+
+	for _, tier := range strings.Fields(val) {
+		code, value, _ := strings.Cut(tier, "=")
+		rps, burst, _ := strings.Cut(value, ":")
+
+		var rate ratelimit.Rate
+		var rpsErr, burstErr error
+
+		rate.RPS, rpsErr = strconv.ParseFloat(rps, 64)
+		rate.Burst, burstErr = strconv.Atoi(burst)
+
+		if code == "" || rpsErr != nil || burstErr != nil {
+			return nil, fmt.Errorf("invalid rate limiter tier %q", tier)
+		}
+
+		tiers[code] = rate
+	}
+
+	return tiers, nil
+}
+
+// The parseSampleRatios() function parses the value of the -access-log-sample flag,
+// which is a space separated list of route patterns and ratios in the form
+// "route=ratio".
+func parseSampleRatios(val string) (map[string]float64, error) {
+	ratios := make(map[string]float64)
+
+	for _, field := range strings.Fields(val) {
+		route, value, _ := strings.Cut(field, "=")
+
+		ratio, err := strconv.ParseFloat(value, 64)
+		if route == "" || err != nil || ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("invalid access log sample ratio %q", field)
+		}
+
+		ratios[route] = ratio
+	}
+
+	return ratios, nil
+}
@@ -1,21 +1,35 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"expvar"
 	"fmt"
+	"math/rand/v2"
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"bookworm.onatim.com/internal/data"
+	"bookworm.onatim.com/internal/jsonlog"
+	"bookworm.onatim.com/internal/metrics"
+	"bookworm.onatim.com/internal/ratelimit"
+	"bookworm.onatim.com/internal/tracing"
 	"bookworm.onatim.com/internal/validator"
-	"github.com/tomasen/realip"
-	"golang.org/x/time/rate"
 )
 
+// The resolveClientIP() middleware works out the IP address of the client, taking the
+// trusted proxies into account, and adds it to the request context for the rate
+// limiter and logging to use.
+func (app *application) resolveClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = app.contextSetClientIP(r, clientIP(r, app.config.proxies.trusted))
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Create a deferred function (which will always be run in the event of a panic
@@ -42,71 +56,152 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
+// The rateLimitIP() middleware limits the total rate of requests from each IP address,
+// whether they're authenticated or not. It must run before authenticate(), so that
+// requests with invalid tokens are limited too, rather than being free to guess tokens
+// and cause a database lookup each. The limit is looser than the anonymous one in
+// rateLimit(), so that users who share an address don't use up each other's limits.
+func (app *application) rateLimitIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.limiter.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if app.allowRequest(w, r, "client:"+app.contextGetClientIP(r), app.config.limiter.ip) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// The rateLimit() middleware checks each request against the rate limiter. Requests
+// from authenticated users are limited per user, at the rate for their tier, and all
+// other requests are limited per IP address. The limiter's state may be kept in memory
+// or shared between instances of the API, depending on the -limiter-store flag. This
+// must run after authenticate(), so that we know who the user is.
 func (app *application) rateLimit(next http.Handler) http.Handler {
-	// Define a client struct to hold the rate limiter and last seen time for each
-	// client.
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only carry out the check if rate limiting is enabled.
+		if !app.config.limiter.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user := app.contextGetUser(r)
+
+		var key string
+		var rate ratelimit.Rate
+
+		if user.IsAnonymous() {
+			// Use the client's IP address, and the anonymous requests-per-second and
+			// burst values from the config struct.
+			key = "ip:" + app.contextGetClientIP(r)
+			rate = ratelimit.Rate{RPS: app.config.limiter.rps, Burst: app.config.limiter.burst}
+		} else {
+			var err error
+
+			key = "user:" + strconv.FormatInt(user.ID, 10)
+			rate, err = app.userRate(user)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		if app.allowRequest(w, r, key, rate) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// The rateLimitRoute() middleware applies a stricter rate limit to a single route, such
+// as logging in, on top of the limit applied by rateLimit(). It's always keyed by IP
+// address, as these routes are mostly used by clients who aren't authenticated yet.
+func (app *application) rateLimitRoute(name string, rate ratelimit.Rate, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.limiter.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if app.allowRequest(w, r, "route:"+name+":"+app.contextGetClientIP(r), rate) {
+			next.ServeHTTP(w, r)
+		}
 	}
+}
 
-	// Declare a mutex and a map to hold the clients' IP addresses and rate limiters.
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
+// The userRate() helper returns the rate limit for an authenticated user. If the user
+// has any of the permissions which have a tier configured, they get the most generous
+// of those tiers, and otherwise the default user rate.
+func (app *application) userRate(user *data.User) (ratelimit.Rate, error) {
+	rate := app.config.limiter.user
 
-	// Launch a background goroutine which removes old entries from the clients map once
-	// every minute.
-	go func() {
-		for {
-			time.Sleep(time.Minute)
+	if len(app.config.limiter.tiers) == 0 {
+		return rate, nil
+	}
 
-			// Lock the mutex to prevent any rate limiter checks from happening while
-			// the cleanup is taking place.
-			mu.Lock()
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return ratelimit.Rate{}, err
+	}
 
-			// Loop through all clients. If they haven't been seen within the last three
-			// minutes, delete the corresponding entry from the map.
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
-			}
+	found := false
 
-			// Importantly, unlock the mutex when the cleanup is complete.
-			mu.Unlock()
+	for _, code := range permissions {
+		tier, ok := app.config.limiter.tiers[code]
+		if ok && (!found || tier.RPS > rate.RPS) {
+			rate = tier
+			found = true
 		}
-	}()
+	}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Only carry out the check if rate limiting is enabled.
-		if app.config.limiter.enabled {
-			// Use the realip.FromRequest() function to get the client's real IP address.
-			ip := realip.FromRequest(r)
+	return rate, nil
+}
 
-			mu.Lock()
+// The allowRequest() helper checks a request against the rate limiter, adding the
+// RateLimit-Limit and RateLimit-Remaining headers to the response. If the request isn't
+// allowed, it sends a 429 response and returns false. When more than one limit applies
+// to a request, the headers are for the last one checked.
+func (app *application) allowRequest(w http.ResponseWriter, r *http.Request, key string, rate ratelimit.Rate) bool {
+	result, err := app.limiter.Allow(r.Context(), key, rate)
+	if err != nil {
+		// If the limiter's store is unavailable, log the error but let the request
+		// through, rather than turning every request away.
+		app.logError(r, err)
+		return true
+	}
 
-			if _, found := clients[ip]; !found {
-				clients[ip] = &client{
-					// Use the requests-per-second and burst values from the config
-					// struct.
-					limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst),
-				}
-			}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+
+	if !result.Allowed {
+		app.rateLimitExceededResponse(w, r, result.RetryAfter)
+		return false
+	}
+
+	return true
+}
 
-			clients[ip].lastSeen = time.Now()
+// The cleanupRateLimits() method starts a background goroutine which removes the rate
+// limiter's state for clients that haven't made any requests recently. It runs every
+// minute, until the done channel is closed.
+func (app *application) cleanupRateLimits(done <-chan struct{}) {
+	app.background(func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
 
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
-				app.rateLimitExceededResponse(w, r)
+		for {
+			select {
+			case <-done:
 				return
+			case <-ticker.C:
 			}
 
-			mu.Unlock()
+			err := app.limiter.Cleanup(context.Background())
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
 		}
-
-		next.ServeHTTP(w, r)
 	})
 }
 
@@ -160,7 +255,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// again calling the invalidAuthenticationTokenResponse() helper if no
 		// matching record was found. IMPORTANT: Notice that we are using
 		// ScopeAuthentication as the first parameter here.
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.models.Users.WithContext(r.Context()).GetForToken(data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -264,6 +359,10 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 				if origin == app.config.cors.trustedOrigins[i] {
 					w.Header().Set("Access-Control-Allow-Origin", origin)
 
+					// Let cross-origin clients read the caching headers, so they can
+					// make conditional requests.
+					w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition, ETag, Idempotent-Replayed, Last-Modified, RateLimit-Limit, RateLimit-Remaining, Retry-After, X-Request-ID")
+
 					// Check if the request has the HTTP method OPTIONS and contains the
 					// "Access-Control-Request-Method" header. If it does, then we treat
 					// it as a preflight request.
@@ -271,7 +370,7 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 						// Set the necessary preflight response headers, as discussed
 						// previously.
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Idempotency-Key, If-Match, If-None-Match, Range, Traceparent, X-Request-ID")
 
 						// Write the headers along with a 200 OK status and return from
 						// the middleware with no further action.
@@ -289,11 +388,13 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 }
 
 // The metricsResponseWriter wraps an existing http.ResponseWriter and also
-// contains a field for recording the response status code, and a boolean flag to
-// indicate whether the response headers have already been written.
+// contains fields for recording the response status code and the number of bytes in
+// the response body, and a boolean flag to indicate whether the response headers have
+// already been written.
 type metricsResponseWriter struct {
 	wrapped       http.ResponseWriter
 	statusCode    int
+	bytesWritten  int
 	headerWritten bool
 }
 
@@ -317,13 +418,15 @@ func (mw *metricsResponseWriter) WriteHeader(statusCode int) {
 // Likewise the Write() method does a 'pass through' to the Write() method of the
 // wrapped http.ResponseWriter. If there wasn't a separate successful call to
 // WriteHeader() we know that Go will default to using the response status 200
-// OK, so this is what we record.
+// OK, so this is what we record. We also add up the number of bytes written.
 func (mw *metricsResponseWriter) Write(b []byte) (int, error) {
 	if !mw.headerWritten {
 		mw.statusCode = http.StatusOK
 		mw.headerWritten = true
 	}
-	return mw.wrapped.Write(b)
+	n, err := mw.wrapped.Write(b)
+	mw.bytesWritten += n
+	return n, err
 }
 
 // We also need an Unwrap() method which returns the existing wrapped
@@ -341,6 +444,21 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		totalResponsesSentByStatus      = expvar.NewMap("total_responses_sent_by_status")
 	)
 
+	// Likewise register the Prometheus metrics. Requests are labelled with the route
+	// pattern that they matched (like "/v1/books/:id") rather than their path, so that
+	// the number of series stays bounded no matter what URLs clients ask for.
+	var (
+		httpRequestsTotal = app.registry.NewCounter("bookworm_http_requests_total",
+			"Total number of HTTP requests served.", "route", "method", "status")
+		httpRequestDuration = app.registry.NewHistogram("bookworm_http_request_duration_seconds",
+			"Time taken to serve HTTP requests.", metrics.DefaultBuckets, "route", "method", "status")
+		httpRequestsInFlight atomic.Int64
+	)
+
+	app.registry.NewGaugeFunc("bookworm_http_requests_in_flight", "Number of HTTP requests currently being served.", func() []metrics.Sample {
+		return metrics.Value(float64(httpRequestsInFlight.Load()))
+	})
+
 	// The following code will be run for every request...
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Record the time that we started to process the request.
@@ -349,6 +467,15 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		// Use the Add() method to increment the number of requests received by 1.
 		totalRequestsReceived.Add(1)
 
+		httpRequestsInFlight.Add(1)
+		defer httpRequestsInFlight.Add(-1)
+
+		// Add a holder for the route pattern to the request context, which is filled
+		// in by the router when the request matches one of our routes. Requests which
+		// don't match any route keep the "unmatched" label.
+		route := "unmatched"
+		r = app.contextSetRoute(r, &route)
+
 		// Create a new metricsResponseWriter, which wraps the original
 		// http.ResponseWriter value that the metrics middleware received.
 		mw := &metricsResponseWriter{wrapped: w}
@@ -371,7 +498,174 @@ func (app *application) metrics(next http.Handler) http.Handler {
 
 		// Calculate the number of microseconds since we began to process the request,
 		// then increment the total processing time by this amount.
-		duration := time.Since(start).Microseconds()
-		totalProcessingTimeMicroseconds.Add(duration)
+		duration := time.Since(start)
+		totalProcessingTimeMicroseconds.Add(duration.Microseconds())
+
+		// A handler which never writes a response sends an empty 200 OK.
+		status := mw.statusCode
+		if !mw.headerWritten {
+			status = http.StatusOK
+		}
+
+		method := metricsMethod(r.Method)
+
+		httpRequestsTotal.Add(1, route, method, strconv.Itoa(status))
+		httpRequestDuration.Observe(duration.Seconds(), route, method, strconv.Itoa(status))
+	})
+}
+
+// The metricsMethod() function returns the value of the method label for a request.
+// Clients can send any token as the method, and each distinct label value creates a new
+// series which is kept forever, so any method other than the standard ones is recorded
+// as "OTHER".
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+// The trace() middleware starts the root span for each request, joining the caller's
+// trace if the request has a traceparent header (such as one added by Caddy), and adds
+// it to the request context so that spans started further down the chain become its
+// children. It sits inside metrics() so that the route the request matched is known by
+// the time the span ends.
+func (app *application) trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := app.tracer.StartRequest(r.Context(), r.Method, r.Header.Get("traceparent"))
+		defer span.End()
+
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+		span.SetAttribute("client.address", app.contextGetClientIP(r))
+
+		mw := &metricsResponseWriter{wrapped: w}
+		next.ServeHTTP(mw, r.WithContext(ctx))
+
+		// Name the span after the route, rather than the path, so that spans for the
+		// same endpoint are grouped together.
+		if route := app.contextGetRoute(r); route != nil {
+			span.SetName(r.Method + " " + *route)
+			span.SetAttribute("http.route", *route)
+		}
+
+		status := mw.statusCode
+		if !mw.headerWritten {
+			status = http.StatusOK
+		}
+		span.SetAttribute("http.status_code", strconv.Itoa(status))
+
+		if status >= 500 {
+			span.SetError(errors.New(http.StatusText(status)))
+		}
+	})
+}
+
+// The traced() function wraps a middleware so that it records a span for the time it
+// spends on each request before handing over to the next handler, or for the whole
+// request if it responds itself (like authenticate() rejecting an invalid token).
+func (app *application) traced(name string, middleware func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		// End the middleware's span when it calls the next handler, and put the parent
+		// span back in the context so the rest of the chain isn't nested inside it.
+		// Anything else the middleware added to the context is kept.
+		inner := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			span := tracing.SpanFromContext(r.Context())
+			span.End()
+
+			ctx := r.Context()
+			if parent, ok := ctx.Value(parentSpanContextKey).(*tracing.Span); ok {
+				ctx = tracing.ContextWithSpan(ctx, parent)
+			}
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			parent := tracing.SpanFromContext(r.Context())
+
+			ctx, span := tracing.Start(r.Context(), "middleware "+name)
+			defer span.End()
+
+			ctx = context.WithValue(ctx, parentSpanContextKey, parent)
+			inner.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// The logRequest() middleware gives each request an ID, taken from the X-Request-ID
+// header if the client (or Caddy) sent a valid one, and echoes it back in the response
+// so that clients can quote it. Once the request has been served, it writes an access
+// log entry. Routes listed in the -access-log-sample flag only have a fraction of their
+// requests logged, but server errors are always logged.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			var err error
+			id, err = newRequestID()
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		span := tracing.SpanFromContext(r.Context())
+		span.SetAttribute("http.request_id", id)
+
+		// Give the request its own logger, which adds the request and trace IDs to
+		// every entry logged while serving it.
+		logger := app.logger.With(jsonlog.String("request_id", id))
+		if span != nil {
+			logger = logger.With(jsonlog.String("trace_id", span.TraceID()))
+		}
+		r = app.contextSetLogger(r, logger)
+
+		var user *data.User
+		r = app.contextSetUserHolder(r, &user)
+
+		mw := &metricsResponseWriter{wrapped: w}
+		next.ServeHTTP(mw, r)
+
+		if !app.config.accessLog.enabled {
+			return
+		}
+
+		route := "unmatched"
+		if holder := app.contextGetRoute(r); holder != nil {
+			route = *holder
+		}
+
+		status := mw.statusCode
+		if !mw.headerWritten {
+			status = http.StatusOK
+		}
+
+		if ratio, ok := app.config.accessLog.sampling[route]; ok && status < 500 && rand.Float64() >= ratio {
+			return
+		}
+
+		attrs := []jsonlog.Attr{
+			jsonlog.String("method", r.Method),
+			jsonlog.String("route", route),
+			jsonlog.String("path", r.URL.Path),
+			jsonlog.Int("status", status),
+			jsonlog.Int("bytes", mw.bytesWritten),
+			jsonlog.Duration("duration", time.Since(start)),
+			jsonlog.String("client_ip", app.contextGetClientIP(r)),
+		}
+
+		if user != nil && !user.IsAnonymous() {
+			attrs = append(attrs, jsonlog.Int64("user_id", user.ID))
+		}
+
+		logger.Info("request", attrs...)
 	})
 }
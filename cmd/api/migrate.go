@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"bookworm.onatim.com/internal/jsonlog"
+	"bookworm.onatim.com/internal/migrate"
+)
+
+var errMigrateUsage = errors.New("usage: api migrate up|down|status|goto N")
+
+// The runMigrate() function runs the "api migrate" command, which applies or rolls back
+// the migrations embedded in the binary:
+//
+//	api migrate up        apply every migration which hasn't been applied yet
+//	api migrate down      roll back the most recently applied migration
+//	api migrate goto N    migrate up or down to version N (0 rolls back everything)
+//	api migrate status    show the current version and which migrations are applied
+func runMigrate(migrator *migrate.Migrator, logger *jsonlog.Logger, args []string) error {
+	if len(args) == 0 {
+		return errMigrateUsage
+	}
+
+	ctx := context.Background()
+
+	var done []int64
+	var err error
+
+	switch args[0] {
+	case "up":
+		if len(args) != 1 {
+			return errMigrateUsage
+		}
+		done, err = migrator.Up(ctx)
+	case "down":
+		if len(args) != 1 {
+			return errMigrateUsage
+		}
+		done, err = migrator.Down(ctx)
+	case "goto":
+		if len(args) != 2 {
+			return errMigrateUsage
+		}
+		target, parseErr := strconv.ParseInt(args[1], 10, 64)
+		if parseErr != nil || target < 0 {
+			return fmt.Errorf("invalid migration version %q", args[1])
+		}
+		done, err = migrator.Goto(ctx, target)
+	case "status":
+		if len(args) != 1 {
+			return errMigrateUsage
+		}
+		return printMigrationStatus(ctx, migrator)
+	default:
+		return errMigrateUsage
+	}
+
+	// Log the migrations which were run even if a later one failed, so it's clear
+	// what state the database was left in.
+	for _, version := range done {
+		logger.Info("migrated", jsonlog.String("direction", args[0]), jsonlog.Int64("version", version))
+	}
+	if err != nil {
+		return err
+	}
+
+	version, _, err := migrator.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("migrations complete", jsonlog.Int64("version", version), jsonlog.Int("count", len(done)))
+	return nil
+}
+
+func printMigrationStatus(ctx context.Context, migrator *migrate.Migrator) error {
+	version, dirty, err := migrator.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Version:\t%d (latest %d)\n", version, migrator.Latest())
+	fmt.Printf("Dirty:\t\t%t\n\n", dirty)
+
+	for _, migration := range migrator.Migrations() {
+		status := "pending"
+		if migration.Version <= version {
+			status = "applied"
+		}
+		fmt.Printf("%s\t%06d_%s\n", status, migration.Version, migration.Name)
+	}
+
+	return nil
+}
@@ -4,8 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 
 	"bookworm.onatim.com/internal/data"
+	"bookworm.onatim.com/internal/metadata"
 	"bookworm.onatim.com/internal/validator"
 )
 
@@ -42,22 +47,67 @@ func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request
 	// Initialize a new Validator instance
 	v := validator.New()
 
+	// If the client sent ?enrich=true (or enrichment is on by default), fill in any
+	// fields they left out using the metadata provider. This is best-effort: if the
+	// lookup fails we carry on with the book as it is, and let the validation below
+	// report anything that's still missing. The cover from the provider is used too.
+	enrich := app.readBool(r.URL.Query(), "enrich", app.config.metadata.enrich, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Load the genre taxonomy to check the book's genres against.
+	taxonomy, err := app.models.Genres.WithContext(r.Context()).Taxonomy()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var record *metadata.Record
+
+	if enrich && book.ISBN > 0 {
+		record, err = app.lookupMetadata(r.Context(), book.ISBN.Digits())
+		switch {
+		case err == nil:
+			fillFromMetadata(book, record, taxonomy)
+		case !errors.Is(err, metadata.ErrNotFound):
+			app.logError(r, err)
+		}
+	}
+
 	// Call the ValidateBook() function and return a response containing the errors if
 	// any of the checks fail.
-	if data.ValidateBook(v, book); !v.Valid() {
+	if data.ValidateBook(v, book, taxonomy); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	// Download the cover before creating the book, so that if the provider's cover
+	// can't be fetched the client gets an error and the book isn't created without it.
+	var cover *metadataCover
+
+	if record != nil && record.CoverURL != "" {
+		cover, err = app.fetchCover(r.Context(), record.CoverURL)
+		if err != nil && !errors.Is(err, metadata.ErrNotFound) {
+			app.badGatewayResponse(w, r, err)
+			return
+		}
+	}
+
 	// Call the Insert() method on our books model, passing in a pointer to the
 	// validated book struct. This will create a record in the database and update the
 	// book struct with the system-generated information.
-	err = app.models.Books.Insert(book)
+	err = app.models.Books.WithContext(r.Context()).Insert(book, app.contextGetUser(r).ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	if cover != nil {
+		app.attachCover(r, book, cover)
+	}
+
 	// When sending a HTTP response, we want to include a Location header to let the
 	// client know which URL they can find the newly-created resource at. We make an
 	// empty http.Header map and then use the Set() method to add a new Location header,
@@ -65,6 +115,10 @@ func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/books/%d", book.ID))
 
+	// Also include the ETag and Last-Modified headers for the new book, so the client
+	// can use them in conditional requests straight away.
+	setBookCacheHeaders(headers, book, false)
+
 	// Write a JSON response with a 201 Created status code, the book data in the
 	// response body, and the Location header.
 	err = app.writeJSON(w, http.StatusCreated, envelope{"book": book}, headers)
@@ -82,10 +136,20 @@ func (app *application) showBookHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Call the Get() method to fetch the data for a specific book. We also need to
-	// use the errors.Is() function to check if it returns a data.ErrRecordNotFound
+	// Read and validate the optional fields and include query string values.
+	v := validator.New()
+
+	fieldset := app.readBookFieldset(r.URL.Query(), "series")
+
+	if data.ValidateFieldset(v, fieldset); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Call the GetFields() method to fetch the data for a specific book. We also need
+	// to use the errors.Is() function to check if it returns a data.ErrRecordNotFound
 	// error, in which case we send a 404 Not Found response to the client.
-	book, err := app.models.Books.Get(id)
+	book, err := app.models.Books.WithContext(r.Context()).GetFields(id, fieldset)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -96,8 +160,41 @@ func (app *application) showBookHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Encode the struct to JSON and send it as the HTTP response.
-	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, nil)
+	// Set the ETag and Last-Modified headers. If the client asked for specific fields
+	// the response is only a partial representation of the book, so we use a weak ETag.
+	headers := make(http.Header)
+	setBookCacheHeaders(headers, book, len(fieldset.Fields) > 0)
+
+	env := envelope{"book": book.Project(fieldset)}
+
+	// Embed any related data that the client asked for. The related records can change
+	// without the book's version changing, so the ETag has to cover their versions too,
+	// and the book's Last-Modified time no longer says when the response last changed.
+	if len(fieldset.Include) > 0 {
+		included, versions, err := app.bookIncludes(r, fieldset, book)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env["included"] = included
+
+		headers.Set("ETag", includedETag(book.Version, versions))
+		headers.Del("Last-Modified")
+	}
+
+	// If the client's cached copy of the book is still current, send a 304 Not
+	// Modified response with no body.
+	if app.notModified(r, headers.Get("ETag"), book.UpdatedAt) {
+		for key, value := range headers {
+			w.Header()[key] = value
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Encode the requested fields of the book to JSON and send it as the HTTP response.
+	err = app.writeJSON(w, http.StatusOK, env, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -113,7 +210,7 @@ func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request
 
 	// Fetch the existing book record from the database, sending a 404 Not Found
 	// response to the client if we couldn't find a matching record.
-	book, err := app.models.Books.Get(id)
+	book, err := app.models.Books.WithContext(r.Context()).Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -124,6 +221,14 @@ func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// If the client sent an If-Match header, check that it matches the current version
+	// of the book, sending a 412 Precondition Failed response if it doesn't.
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && !etagMatches(ifMatch, etag(book.Version, false), true) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
 	// Declare an input struct to hold the expected data from the client.
 	var input struct {
 		Title  *string    `json:"title"`
@@ -160,19 +265,30 @@ func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request
 		book.Genres = input.Genres // Note that we don't need to dereference a slice.
 	}
 
+	// Load the genre taxonomy to check the book's genres against.
+	taxonomy, err := app.models.Genres.WithContext(r.Context()).Taxonomy()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	// Validate the updated book record, sending the client a 422 Unprocessable Entity
 	// response if any checks fail.
 	v := validator.New()
 
-	if data.ValidateBook(v, book); !v.Valid() {
+	if data.ValidateBook(v, book, taxonomy); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	// Pass the updated book record to our Update() method.
-	err = app.models.Books.Update(book)
+	// Pass the updated book record to our Update() method. If the book was changed by
+	// someone else in the meantime and the client made the request conditional with
+	// If-Match, we send a 412 Precondition Failed response rather than a 409 Conflict.
+	err = app.models.Books.WithContext(r.Context()).Update(book, app.contextGetUser(r).ID)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrEditConflict) && ifMatch != "":
+			app.preconditionFailedResponse(w, r)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -181,8 +297,12 @@ func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Write the updated book record in a JSON response.
-	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, nil)
+	// Write the updated book record in a JSON response, along with its new ETag and
+	// Last-Modified headers.
+	headers := make(http.Header)
+	setBookCacheHeaders(headers, book, false)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -196,13 +316,45 @@ func (app *application) deleteBookHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// If the client sent an If-Match header, fetch the book and check that the header
+	// matches its current version. That version is passed on to Delete(), which checks
+	// it again with the book locked, in case the book was updated in the meantime.
+	var version int32
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" {
+		book, err := app.models.Books.WithContext(r.Context()).Get(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !etagMatches(ifMatch, etag(book.Version, false), true) {
+			app.preconditionFailedResponse(w, r)
+			return
+		}
+
+		// "If-Match: *" only requires the book to exist, whatever its version.
+		if strings.TrimSpace(ifMatch) != "*" {
+			version = book.Version
+		}
+	}
+
 	// Delete the book from the database, sending a 404 Not Found response to the
-	// client if there isn't a matching record.
-	err = app.models.Books.Delete(id)
+	// client if there isn't a matching record, or a 412 Precondition Failed response
+	// if it changed after we checked the If-Match header.
+	err = app.models.Books.WithContext(r.Context()).Delete(id, version, app.contextGetUser(r).ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -223,6 +375,7 @@ func (app *application) listBooksHandler(w http.ResponseWriter, r *http.Request)
 		Title  string
 		Genres []string
 		data.Filters
+		data.Fieldset
 	}
 
 	// Initialize a new Validator instance.
@@ -248,23 +401,125 @@ func (app *application) listBooksHandler(w http.ResponseWriter, r *http.Request)
 	input.Filters.Sort = app.readString(qs, "sort", "id")
 	input.Filters.SortSafelist = []string{"id", "title", "year", "isbn", "-id", "-title", "-year", "-isbn"}
 
+	// Extract the optional cursor for keyset pagination. When a cursor is present the
+	// page value is ignored, and the cursor's signature is checked against our secret
+	// when the filters are validated.
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.CursorSecret = app.config.cursor.secret
+
+	// Read the optional fields and include query string values.
+	input.Fieldset = app.readBookFieldset(qs, "series")
+
 	// Check the Validator instance for any errors and use the failedValidationResponse()
 	// helper to send the client a response if necessary.
-	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+	data.ValidateFilters(v, input.Filters)
+	data.ValidateFieldset(v, input.Fieldset)
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	// Resolve the genres to filter by into their slugs, so that aliases and different
+	// spellings of a genre all work.
+	taxonomy, err := app.models.Genres.WithContext(r.Context()).Taxonomy()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	input.Genres = taxonomy.Normalize(input.Genres)
+
 	// Accept the metadata struct as a return value.
-	books, metadata, err := app.models.Books.GetAll(input.Title, input.Genres, input.Filters)
+	books, metadata, err := app.models.Books.WithContext(r.Context()).GetAll(input.Title, input.Genres, input.Filters, input.Fieldset)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	// Limit each book to the requested fields.
+	projected := make([]any, len(books))
+	for i, book := range books {
+		projected[i] = book.Project(input.Fieldset)
+	}
+
+	env := envelope{"books": projected, "metadata": metadata}
+
+	// Embed any related data that the client asked for.
+	if len(input.Fieldset.Include) > 0 {
+		env["included"], _, err = app.bookIncludes(r, input.Fieldset, books...)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
 	// Include the metadata in the response envelope.
-	err = app.writeJSON(w, http.StatusOK, envelope{"books": books, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The readBookFieldset() helper reads the fields and include query string values for
+// the book endpoints, along with the safelists they are validated against. The related
+// data which an endpoint can embed (see bookIncludes()) is passed in as includes.
+func (app *application) readBookFieldset(qs url.Values, includes ...string) data.Fieldset {
+	return data.Fieldset{
+		Fields:          app.readCSV(qs, "fields", nil),
+		FieldSafelist:   []string{"id", "title", "year", "ISBN", "genres", "version", "cover_url", "series", "series_position"},
+		Include:         app.readCSV(qs, "include", nil),
+		IncludeSafelist: includes,
+	}
+}
+
+// The bookIncludes() helper fetches the related data that the client asked to have
+// embedded alongside the given books, keyed by the name of the relation. Each related
+// record appears once, however many of the books refer to it. It also returns the
+// version of each related record, for building an ETag with includedETag().
+func (app *application) bookIncludes(r *http.Request, fieldset data.Fieldset, books ...*data.Book) (envelope, []string, error) {
+	included := envelope{}
+	var versions []string
+
+	if fieldset.Includes("series") {
+		var ids []int64
+		for _, book := range books {
+			if book.SeriesID != nil && !slices.Contains(ids, *book.SeriesID) {
+				ids = append(ids, *book.SeriesID)
+			}
+		}
+
+		series, err := app.models.Series.WithContext(r.Context()).GetMany(ids)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, s := range series {
+			versions = append(versions, fmt.Sprintf("series.%d.%d", s.ID, s.Version))
+		}
+
+		included["series"] = series
+	}
+
+	return included, versions, nil
+}
+
+// The setBookCacheHeaders() helper adds the ETag and Last-Modified headers for a book to
+// the given header map. The ETag is derived from the book's version number, so it
+// changes whenever the book is updated.
+func setBookCacheHeaders(headers http.Header, book *data.Book, weak bool) {
+	headers.Set("ETag", etag(book.Version, weak))
+
+	if !book.UpdatedAt.IsZero() {
+		headers.Set("Last-Modified", book.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// The includedETag() helper returns the ETag for a book response with related records
+// embedded in it, which combines the book's version with the versions returned by
+// bookIncludes(). It's always weak, as the response is more than a representation of
+// the book, so it can't be used with If-Match.
+func includedETag(version int32, included []string) string {
+	tag := strings.Join(append([]string{strconv.Itoa(int(version))}, included...), "-")
+	return "W/" + strconv.Quote(tag)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"bookworm.onatim.com/internal/data"
+	"bookworm.onatim.com/internal/validator"
+)
+
+// Add a listSimilarBooksHandler for the "GET /v1/books/:id/similar" endpoint, which
+// returns the books most similar to the given book, best matches first. The results
+// come from the last refresh by the refreshRecommendations() worker, so newly added
+// books won't appear until the next refresh.
+func (app *application) listSimilarBooksHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	filters, fieldset, ok := app.readRecommendationParams(w, r)
+	if !ok {
+		return
+	}
+
+	// Check that the book exists, so that we can tell the client the difference
+	// between a missing book and one which has nothing similar to it.
+	_, err = app.models.Books.WithContext(r.Context()).GetFields(id, data.Fieldset{Fields: []string{"id"}})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	recommendations, metadata, err := app.models.Recommendations.GetSimilar(id, filters, fieldset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"books": projectRecommendations(recommendations, fieldset), "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add a listRecommendationsHandler for the "GET /v1/users/me/recommendations" endpoint,
+// which returns the recommended books for the current user, best matches first.
+func (app *application) listRecommendationsHandler(w http.ResponseWriter, r *http.Request) {
+	filters, fieldset, ok := app.readRecommendationParams(w, r)
+	if !ok {
+		return
+	}
+
+	recommendations, metadata, err := app.models.Recommendations.GetForUser(app.contextGetUser(r).ID, filters, fieldset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"books": projectRecommendations(recommendations, fieldset), "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readRecommendationParams() helper reads and validates the pagination and fields
+// query string values for the recommendation endpoints. Results are always sorted by
+// score. If the values are invalid it sends the error response itself and returns false.
+func (app *application) readRecommendationParams(w http.ResponseWriter, r *http.Request) (data.Filters, data.Fieldset, bool) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 10, v),
+		Sort:         "-score",
+		SortSafelist: []string{"-score"},
+	}
+
+	fieldset := app.readBookFieldset(qs)
+
+	data.ValidateFilters(v, filters)
+	data.ValidateFieldset(v, fieldset)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return data.Filters{}, data.Fieldset{}, false
+	}
+
+	return filters, fieldset, true
+}
+
+// The projectRecommendations() function limits each recommended book to the fields in
+// the fieldset, and pairs it with its score.
+func projectRecommendations(recommendations []*data.Recommendation, fieldset data.Fieldset) []envelope {
+	projected := make([]envelope, len(recommendations))
+	for i, recommendation := range recommendations {
+		projected[i] = envelope{"score": recommendation.Score, "book": recommendation.Book.Project(fieldset)}
+	}
+	return projected
+}
+
+// The refreshRecommendations() method starts a background goroutine which recomputes the
+// similar books and user recommendations. It runs once at startup and then at the
+// configured interval, until the done channel is closed. A refresh can take a while, so
+// closing the channel also cancels any refresh in progress, rather than holding up the
+// shutdown until it finishes.
+func (app *application) refreshRecommendations(done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	app.background(func() {
+		ticker := time.NewTicker(app.config.recommendations.interval)
+		defer ticker.Stop()
+
+		for {
+			start := time.Now()
+
+			// A refresh which fails because it was cancelled isn't worth logging.
+			refreshed, err := app.models.Recommendations.Refresh(ctx)
+			switch {
+			case err != nil && ctx.Err() == nil:
+				app.logger.PrintError(err, nil)
+			case err == nil && refreshed:
+				app.logger.PrintInfo("refreshed recommendations", map[string]string{
+					"duration": time.Since(start).String(),
+				})
+			}
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"bookworm.onatim.com/internal/data"
+	"bookworm.onatim.com/internal/validator"
+)
+
+// Add a listBookHistoryHandler for the "GET /v1/books/:id/history" endpoint, which
+// returns the revisions recorded for a book, most recent first.
+func (app *application) listBookHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	// Revisions are always listed by version, so there's only one sort value.
+	input.Filters.Sort = "-version"
+	input.Filters.SortSafelist = []string{"-version"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	revisions, metadata, err := app.models.Revisions.WithContext(r.Context()).GetAllForBook(id, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"revisions": revisions, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add a revertBookHandler for the "POST /v1/books/:id/revert" endpoint. This sets the
+// fields of a book back to how they were at an earlier version. The change goes through
+// the same validation and optimistic concurrency checks as updateBookHandler, so the
+// client must send the version of the book that they expect to be reverting, and the
+// revert is itself recorded as a new revision.
+func (app *application) revertBookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		ToVersion int32 `json:"to_version"`
+		Version   int32 `json:"version"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.ToVersion > 0, "to_version", "must be provided")
+	v.Check(input.Version > 0, "version", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	book, err := app.models.Books.WithContext(r.Context()).Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// If the book has changed since the client last saw it, send an edit conflict
+	// response straight away.
+	if book.Version != input.Version {
+		app.editConflictResponse(w, r)
+		return
+	}
+
+	revision, err := app.models.Revisions.WithContext(r.Context()).GetVersion(id, input.ToVersion)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("to_version", "no revision found for this version")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if revision.State.Deleted {
+		v.AddError("to_version", "cannot revert to a version where the book was deleted")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Copy the fields from the revision to the book, then validate and save it in the
+	// same way as updateBookHandler.
+	revision.State.Apply(book)
+
+	// Load the genre taxonomy to check the book's genres against.
+	taxonomy, err := app.models.Genres.WithContext(r.Context()).Taxonomy()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if data.ValidateBook(v, book, taxonomy); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Books.WithContext(r.Context()).Update(book, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -3,30 +3,136 @@ package main
 import (
 	"expvar"
 	"net/http"
+	"strings"
 
+	"bookworm.onatim.com/internal/tracing"
 	"github.com/julienschmidt/httprouter"
 )
 
 func (app *application) routes() http.Handler {
-	router := httprouter.New()
+	router := app.newRouter()
 
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck/live", app.liveHealthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck/ready", app.readyHealthcheckHandler)
 
 	router.HandlerFunc(http.MethodGet, "/v1/books", app.requirePermission("books:read", app.listBooksHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/books", app.requirePermission("books:write", app.createBookHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/books/:id", app.requirePermission("books:read", app.showBookHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/books", app.requirePermission("books:write", app.idempotent(app.createBookHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id", app.staticOrID(map[string]http.HandlerFunc{
+		"import": app.requirePermission("books:write", app.importBooksHandler),
+		"batch":  app.requirePermission("books:write", app.batchBooksHandler),
+		"lookup": app.requirePermission("books:write", app.lookupBookHandler),
+	}, app.methodNotAllowedResponse))
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id", app.staticOrID(map[string]http.HandlerFunc{
+		"export": app.requirePermission("books:read", app.exportBooksHandler),
+		"trash":  app.requirePermission("books:write", app.listTrashHandler),
+	}, app.requirePermission("books:read", app.showBookHandler)))
 	router.HandlerFunc(http.MethodPatch, "/v1/books/:id", app.requirePermission("books:write", app.updateBookHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/books/:id", app.requirePermission("books:write", app.deleteBookHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id/restore", app.requirePermission("books:write", app.restoreBookHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/books/:id/cover", app.requirePermission("books:write", app.updateBookCoverHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/books/:id/cover", app.requirePermission("books:write", app.deleteBookCoverHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id/files", app.requirePermission("books:read", app.listBookFilesHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/books/:id/files/:format", app.requirePermission("books:write", app.uploadBookFileHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id/files/:format", app.requireSignatureOrPermission("books:download", app.downloadBookFileHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/books/:id/files/:format", app.requirePermission("books:write", app.deleteBookFileHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id/files/:format/url", app.requirePermission("books:download", app.createDownloadURLHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id/similar", app.requirePermission("books:read", app.listSimilarBooksHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id/history", app.requirePermission("books:read", app.listBookHistoryHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id/revert", app.requirePermission("books:write", app.revertBookHandler))
 
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/covers/*path", app.showCoverHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/series", app.requirePermission("books:read", app.listSeriesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/series", app.requirePermission("books:write", app.createSeriesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/series/:id", app.requirePermission("books:read", app.showSeriesHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/series/:id", app.requirePermission("books:write", app.updateSeriesHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/series/:id", app.requirePermission("books:write", app.deleteSeriesHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/series/:id/books/:book_id", app.requirePermission("books:write", app.putSeriesBookHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/series/:id/books/:book_id", app.requirePermission("books:write", app.deleteSeriesBookHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/genres", app.requirePermission("books:read", app.listGenresHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/genres", app.requirePermission("books:write", app.createGenreHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/genres/:slug", app.requirePermission("books:read", app.showGenreHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/genres/:slug", app.requirePermission("books:write", app.updateGenreHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/genres/:slug", app.requirePermission("books:write", app.deleteGenreHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/genres/:slug/merge", app.requirePermission("books:write", app.mergeGenreHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/users", app.rateLimitRoute("register", app.config.limiter.auth, app.idempotent(app.registerUserHandler)))
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/recommendations", app.requirePermission("books:read", app.listRecommendationsHandler))
 
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.rateLimitRoute("login", app.config.limiter.auth, app.createAuthenticationTokenHandler))
 
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	router.HandlerFunc(http.MethodGet, "/debug/log-level", app.showLogLevelHandler)
+	router.HandlerFunc(http.MethodPut, "/debug/log-level", app.requirePermission("admin:write", app.updateLogLevelHandler))
+	router.Handler(http.MethodGet, "/metrics", app.registry)
+
+	return app.resolveClientIP(app.metrics(app.trace(app.logRequest(app.recoverPanic(
+		app.traced("enableCORS", app.enableCORS)(
+			app.traced("rateLimitIP", app.rateLimitIP)(
+				app.traced("authenticate", app.authenticate)(
+					app.traced("rateLimit", app.rateLimit)(router)))))))))
+}
+
+// httprouter doesn't allow a static path segment in the same position as a wildcard,
+// so routes like "GET /v1/books/export" can't be registered alongside
+// "GET /v1/books/:id". The staticOrID() function works around this by checking the
+// value of the :id parameter and dispatching to the matching handler in the static
+// map, falling back to the next handler for anything else. The same goes for POST
+// routes like "/v1/books/import" and "/v1/books/:id/restore"; there's no
+// "POST /v1/books/:id" endpoint, so the fallback there is a 405 response.
+func (app *application) staticOrID(static map[string]http.HandlerFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+
+		if handler, ok := static[params.ByName("id")]; ok {
+			// Label the request in the metrics with the static path it was sent to,
+			// rather than the wildcard route.
+			if route := app.contextGetRoute(r); route != nil {
+				*route = strings.Replace(*route, ":id", params.ByName("id"), 1)
+			}
+
+			handler(w, r)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// The patternRouter type wraps httprouter.Router so that every handler records the
+// pattern of the route it was registered with (like "/v1/books/:id") in the request
+// context, for the metrics and tracing middleware to label the request with, and
+// records a span for the handler. httprouter doesn't otherwise make the matched
+// pattern available.
+type patternRouter struct {
+	*httprouter.Router
+	app *application
+}
+
+func (app *application) newRouter() *patternRouter {
+	return &patternRouter{Router: httprouter.New(), app: app}
+}
+
+func (rt *patternRouter) Handler(method, path string, handler http.Handler) {
+	rt.Router.Handler(method, path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := rt.app.contextGetRoute(r); route != nil {
+			*route = path
+		}
+
+		// Record a span for the handler itself, separate from the middleware.
+		ctx, span := tracing.Start(r.Context(), "handler "+method+" "+path)
+		defer span.End()
+
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	}))
+}
 
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+func (rt *patternRouter) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	rt.Handler(method, path, handler)
 }
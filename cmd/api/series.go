@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"bookworm.onatim.com/internal/data"
+	"bookworm.onatim.com/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Add a listSeriesHandler for the "GET /v1/series" endpoint.
+func (app *application) listSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Title = app.readString(qs, "title", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "title", "-id", "-title"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	series, metadata, err := app.models.Series.WithContext(r.Context()).GetAll(input.Title, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"series": series, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add a createSeriesHandler for the "POST /v1/series" endpoint. Books are added to the
+// series afterwards with "PUT /v1/series/:id/books/:book_id".
+func (app *application) createSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	series := &data.Series{
+		Title:       input.Title,
+		Description: input.Description,
+	}
+
+	v := validator.New()
+
+	if data.ValidateSeries(v, series); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Series.WithContext(r.Context()).Insert(series)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/series/%d", series.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"series": series}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add a showSeriesHandler for the "GET /v1/series/:id" endpoint, which returns the
+// series along with its books in reading order. The fields query string value works
+// the same way as it does for the book endpoints.
+func (app *application) showSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	fieldset := app.readBookFieldset(r.URL.Query())
+
+	if data.ValidateFieldset(v, fieldset); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	series, err := app.models.Series.WithContext(r.Context()).Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	books, err := app.models.Series.WithContext(r.Context()).GetBooks(id, fieldset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	projected := make([]any, len(books))
+	for i, book := range books {
+		projected[i] = book.Project(fieldset)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"series": series, "books": projected}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add an updateSeriesHandler for the "PATCH /v1/series/:id" endpoint.
+func (app *application) updateSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	series, err := app.models.Series.WithContext(r.Context()).Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Title       *string `json:"title"`
+		Description *string `json:"description"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Title != nil {
+		series.Title = *input.Title
+	}
+	if input.Description != nil {
+		series.Description = *input.Description
+	}
+
+	v := validator.New()
+
+	if data.ValidateSeries(v, series); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Series.WithContext(r.Context()).Update(series)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"series": series}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add a deleteSeriesHandler for the "DELETE /v1/series/:id" endpoint. The books in the
+// series are kept.
+func (app *application) deleteSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Series.WithContext(r.Context()).Delete(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "series successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add a putSeriesBookHandler for the "PUT /v1/series/:id/books/:book_id" endpoint,
+// which adds a book to the series at the position in the request body, or moves it to
+// that position if it's already in the series. Books can only be in one series, so
+// this also takes the book out of any other series. Like the other endpoints which
+// change a book, the client can send an If-Match header with the book's ETag.
+func (app *application) putSeriesBookHandler(w http.ResponseWriter, r *http.Request) {
+	series, book, ok := app.readSeriesBook(w, r)
+	if !ok {
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && !etagMatches(ifMatch, etag(book.Version, false), true) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Position *float64 `json:"position"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateSeriesPosition(v, input.Position); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Books.WithContext(r.Context()).SetSeries(book, &series.ID, input.Position)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict) && ifMatch != "":
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	setBookCacheHeaders(headers, book, false)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add a deleteSeriesBookHandler for the "DELETE /v1/series/:id/books/:book_id" endpoint,
+// which takes a book out of the series.
+func (app *application) deleteSeriesBookHandler(w http.ResponseWriter, r *http.Request) {
+	series, book, ok := app.readSeriesBook(w, r)
+	if !ok {
+		return
+	}
+
+	if book.SeriesID == nil || *book.SeriesID != series.ID {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && !etagMatches(ifMatch, etag(book.Version, false), true) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	err := app.models.Books.WithContext(r.Context()).SetSeries(book, nil, nil)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict) && ifMatch != "":
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	setBookCacheHeaders(headers, book, false)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readSeriesBook() helper fetches the series and book named by the :id and
+// :book_id URL parameters. If either of them doesn't exist, it sends the error
+// response itself and returns false.
+func (app *application) readSeriesBook(w http.ResponseWriter, r *http.Request) (*data.Series, *data.Book, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, nil, false
+	}
+
+	bookID, err := strconv.ParseInt(httprouter.ParamsFromContext(r.Context()).ByName("book_id"), 10, 64)
+	if err != nil || bookID < 1 {
+		app.notFoundResponse(w, r)
+		return nil, nil, false
+	}
+
+	series, err := app.models.Series.WithContext(r.Context()).Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, nil, false
+	}
+
+	book, err := app.models.Books.WithContext(r.Context()).Get(bookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, nil, false
+	}
+
+	return series, book, true
+}
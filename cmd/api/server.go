@@ -25,6 +25,15 @@ func (app *application) serve() error {
 	// by the graceful Shutdown() function.
 	shutdownError := make(chan error)
 
+	// Create a done channel, which we close during shutdown to tell our long-running
+	// background workers to stop, and start the workers.
+	done := make(chan struct{})
+
+	app.purgeTrash(done)
+	app.purgeIdempotencyKeys(done)
+	app.refreshRecommendations(done)
+	app.cleanupRateLimits(done)
+
 	// Start a background goroutine.
 	go func() {
 		// Create a quit channel which carries os.Signal values.
@@ -44,6 +53,20 @@ func (app *application) serve() error {
 			"signal": s.String(),
 		})
 
+		// Report that we're no longer ready, so that the readiness healthcheck fails
+		// for any requests which arrive while the server is shutting down. Then keep
+		// serving requests for the drain period, which gives the load balancer time to
+		// see the failing healthcheck and stop sending us new requests before we stop
+		// accepting connections.
+		app.shuttingDown.Store(true)
+
+		if app.config.shutdown.drain > 0 {
+			app.logger.PrintInfo("draining requests", map[string]string{
+				"drain": app.config.shutdown.drain.String(),
+			})
+			time.Sleep(app.config.shutdown.drain)
+		}
+
 		// Create a context with a 5-second timeout.
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
@@ -55,8 +78,10 @@ func (app *application) serve() error {
 			shutdownError <- err
 		}
 
-		// Log a message to say that we're waiting for any background goroutines to
-		// complete their tasks.
+		// Tell the background workers to stop, then log a message to say that we're
+		// waiting for any background goroutines to complete their tasks.
+		close(done)
+
 		app.logger.PrintInfo("completing background tasks", map[string]string{
 			"addr": srv.Addr,
 		})
@@ -66,6 +91,17 @@ func (app *application) serve() error {
 		// the shutdownError channel, to indicate that the shutdown completed without
 		// any issues.
 		app.wg.Wait()
+
+		// Export any spans which are still waiting to be sent, now that nothing else
+		// will be traced.
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err = app.tracer.Shutdown(ctx)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"component": "tracing"})
+		}
+
 		shutdownError <- nil
 	}()
 
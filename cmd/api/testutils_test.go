@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"bookworm.onatim.com/internal/data"
+	"bookworm.onatim.com/internal/jsonlog"
+	"bookworm.onatim.com/internal/metadata"
+	"bookworm.onatim.com/internal/storage"
+)
+
+// fakeDB is a database/sql connector which answers queries with canned rows, so that
+// handlers can be tested without PostgreSQL. Each query is answered by the first
+// response whose match string it contains, and queries with no response fail.
+type fakeDB struct {
+	mu        sync.Mutex
+	responses []fakeResponse
+	queries   []string
+}
+
+type fakeResponse struct {
+	match   string
+	columns []string
+	rows    [][]driver.Value
+}
+
+// The on() method adds a response for queries containing match.
+func (db *fakeDB) on(match string, columns []string, rows ...[]driver.Value) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.responses = append(db.responses, fakeResponse{match: match, columns: columns, rows: rows})
+}
+
+// The ran() method reports whether a query containing match has been run.
+func (db *fakeDB) ran(match string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, query := range db.queries {
+		if strings.Contains(query, match) {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *fakeDB) respond(query string) (*fakeResponse, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.queries = append(db.queries, query)
+
+	for i := range db.responses {
+		if strings.Contains(query, db.responses[i].match) {
+			return &db.responses[i], nil
+		}
+	}
+	return nil, fmt.Errorf("fakedb: unexpected query: %s", query)
+}
+
+func (db *fakeDB) Connect(ctx context.Context) (driver.Conn, error) { return fakeConn{db}, nil }
+func (db *fakeDB) Driver() driver.Driver                            { return nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("fakedb: prepared statements aren't supported")
+}
+func (c fakeConn) Close() error              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+func (c fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	response, err := c.db.respond(query)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{columns: response.columns, rows: response.rows}, nil
+}
+
+func (c fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	response, err := c.db.respond(query)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(len(response.rows)), nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// The newTestApplication() function returns an application which uses the fake
+// database and metadata provider, and stores files in a temporary directory.
+func newTestApplication(t *testing.T, db *fakeDB, provider metadata.Provider) *application {
+	t.Helper()
+
+	conn := sql.OpenDB(db)
+	t.Cleanup(func() { conn.Close() })
+
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &application{
+		logger:   jsonlog.New(io.Discard, jsonlog.LevelOff),
+		models:   data.NewModels(conn),
+		metadata: provider,
+		storage:  store,
+	}
+}
+
+// The newTestRequest() function returns a request with a JSON body, and the values in
+// its context which the middleware would normally add.
+func newTestRequest(t *testing.T, method, target string, body any) *http.Request {
+	t.Helper()
+
+	js, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(method, target, bytes.NewReader(js))
+	r = r.WithContext(context.WithValue(r.Context(), clientIPContextKey, "192.0.2.1"))
+
+	return (&application{}).contextSetUser(r, &data.User{ID: 1, Activated: true})
+}
+
+// The decodeResponse() function checks the status code of a response and decodes its
+// JSON body.
+func decodeResponse(t *testing.T, rr *httptest.ResponseRecorder, wantStatus int) map[string]json.RawMessage {
+	t.Helper()
+
+	if rr.Code != wantStatus {
+		t.Fatalf("got status %d; want %d (body: %s)", rr.Code, wantStatus, rr.Body)
+	}
+
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
@@ -36,7 +36,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	// Lookup the user record based on the email address. If no matching user was
 	// found, then we call the app.invalidCredentialsResponse() helper to send a 401
 	// Unauthorized response to the client (we will create this helper in a moment).
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.WithContext(r.Context()).GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
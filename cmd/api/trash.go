@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"bookworm.onatim.com/internal/data"
+	"bookworm.onatim.com/internal/validator"
+)
+
+// Add a listTrashHandler for the "GET /v1/books/trash" endpoint, which lists the books
+// that have been deleted but not yet purged.
+func (app *application) listTrashHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	// Default to showing the most recently deleted books first.
+	input.Filters.Sort = app.readString(qs, "sort", "-deleted_at")
+	input.Filters.SortSafelist = []string{"id", "title", "deleted_at", "-id", "-title", "-deleted_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	books, metadata, err := app.models.Books.WithContext(r.Context()).GetTrash(input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"books": books, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Add a restoreBookHandler for the "POST /v1/books/:id/restore" endpoint, which moves a
+// book out of the trash.
+func (app *application) restoreBookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	book, err := app.models.Books.WithContext(r.Context()).Restore(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The purgeTrash() method starts a background goroutine which permanently deletes books
+// that have been in the trash for longer than the configured retention period. It runs
+// once at startup and then every hour, until the done channel is closed.
+func (app *application) purgeTrash(done <-chan struct{}) {
+	app.background(func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			purged, keys, err := app.models.Books.Purge(time.Now().Add(-app.config.trash.retention))
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			} else if purged > 0 {
+				// Delete the cover images and ebook files which belonged to the
+				// purged books.
+				app.deleteObjects(keys...)
+
+				app.logger.PrintInfo("purged books from trash", map[string]string{
+					"count": strconv.FormatInt(purged, 10),
+				})
+			}
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
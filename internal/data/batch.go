@@ -0,0 +1,196 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"bookworm.onatim.com/internal/validator"
+)
+
+// Define the kinds of operation which can be run by BookModel.Batch().
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// Define errors which can be recorded against a batch operation, in addition to
+// ErrRecordNotFound and ErrEditConflict.
+var (
+	ErrFailedValidation = errors.New("failed validation")
+	ErrBatchAborted     = errors.New("batch aborted")
+)
+
+// A BookPatch holds new values for the fields of a book. Like the input struct in the
+// updateBookHandler, a nil field means that the value should be left unchanged.
+type BookPatch struct {
+	Title  *string  `json:"title"`
+	Year   *int32   `json:"year"`
+	ISBN   *ISBN    `json:"ISBN"`
+	Genres []string `json:"genres"`
+}
+
+// Apply copies the non-nil fields in the patch to the book.
+func (p BookPatch) Apply(book *Book) {
+	if p.Title != nil {
+		book.Title = *p.Title
+	}
+	if p.Year != nil {
+		book.Year = *p.Year
+	}
+	if p.ISBN != nil {
+		book.ISBN = *p.ISBN
+	}
+	if p.Genres != nil {
+		book.Genres = p.Genres
+	}
+}
+
+// A BatchOperation describes a single create, update or delete in a batch. The ID and
+// Version fields identify the book for updates and deletes, and the version must match
+// the current version of the book for the operation to go ahead.
+type BatchOperation struct {
+	Op      string
+	ID      int64
+	Version int32
+	Patch   BookPatch
+}
+
+// A BatchResult holds the outcome of a single operation. If the operation failed, Err
+// holds the reason and, for ErrFailedValidation, Errors holds the validation errors.
+type BatchResult struct {
+	Book   *Book
+	Err    error
+	Errors map[string]string
+}
+
+// The Batch() method runs a list of operations inside a single transaction. Each
+// operation runs inside a savepoint, so a failed operation can be undone on its own.
+// When atomic is true, the first failure rolls back the entire batch and every other
+// operation is marked with ErrBatchAborted. Otherwise failures are recorded and the
+// remaining operations still go ahead. Unexpected database errors are returned as the
+// error value, and always roll back the whole batch.
+func (m BookModel) Batch(ops []BatchOperation, atomic bool, userID int64) ([]BatchResult, error) {
+	ctx, span := m.startSpan("BookModel.Batch")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	results := make([]BatchResult, len(ops))
+
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		// Load the genre taxonomy once for the whole batch, to validate the books against.
+		taxonomy, err := getTaxonomy(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		for i, op := range ops {
+			_, err := tx.ExecContext(ctx, "SAVEPOINT batch_operation")
+			if err != nil {
+				return err
+			}
+
+			results[i] = runBatchOperation(ctx, tx, taxonomy, op, userID)
+
+			switch {
+			case results[i].Err == nil:
+				_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT batch_operation")
+			case !isBatchError(results[i].Err):
+				return results[i].Err
+			case atomic:
+				for j := range results {
+					if j != i {
+						results[j] = BatchResult{Err: ErrBatchAborted}
+					}
+				}
+				// Roll back the transaction, but still return the results.
+				return ErrBatchAborted
+			default:
+				_, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT batch_operation")
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrBatchAborted) {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// Run a single batch operation on the transaction, recording a revision for any change
+// that it makes.
+func runBatchOperation(ctx context.Context, tx *sql.Tx, taxonomy *Taxonomy, op BatchOperation, userID int64) BatchResult {
+	if op.Op == BatchCreate {
+		book := &Book{}
+		op.Patch.Apply(book)
+
+		return validateAndRun(book, taxonomy, func() error {
+			err := insertBook(ctx, tx, book)
+			if err != nil {
+				return err
+			}
+			return recordRevision(ctx, tx, RevisionCreate, nil, book, userID)
+		})
+	}
+
+	// For updates and deletes, fetch and lock the current book so that we can tell
+	// apart a missing record and a version mismatch.
+	before, err := lockBook(ctx, tx, op.ID)
+	if err != nil {
+		return BatchResult{Err: err}
+	}
+
+	if before.Version != op.Version {
+		return BatchResult{Err: ErrEditConflict}
+	}
+
+	if op.Op == BatchDelete {
+		err := deleteBook(ctx, tx, op.ID)
+		if err == nil {
+			err = recordRevision(ctx, tx, RevisionDelete, before, deletedBook(before), userID)
+		}
+		return BatchResult{Err: err}
+	}
+
+	book := *before
+	op.Patch.Apply(&book)
+
+	return validateAndRun(&book, taxonomy, func() error {
+		err := updateBook(ctx, tx, &book)
+		if err != nil {
+			return err
+		}
+		return recordRevision(ctx, tx, RevisionUpdate, before, &book, userID)
+	})
+}
+
+// Validate the book before calling fn to save it.
+func validateAndRun(book *Book, taxonomy *Taxonomy, fn func() error) BatchResult {
+	v := validator.New()
+
+	if ValidateBook(v, book, taxonomy); !v.Valid() {
+		return BatchResult{Err: ErrFailedValidation, Errors: v.Errors}
+	}
+
+	err := fn()
+	if err != nil {
+		return BatchResult{Err: err}
+	}
+
+	return BatchResult{Book: book}
+}
+
+// Report whether err is an expected outcome for a batch operation, rather than a
+// problem with the database.
+func isBatchError(err error) bool {
+	return errors.Is(err, ErrRecordNotFound) || errors.Is(err, ErrEditConflict) || errors.Is(err, ErrFailedValidation)
+}
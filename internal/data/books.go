@@ -5,8 +5,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"bookworm.onatim.com/internal/tracing"
 	"bookworm.onatim.com/internal/validator"
 	"github.com/lib/pq"
 )
@@ -14,6 +16,7 @@ import (
 type Book struct {
 	ID        int64     `json:"id"`
 	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
 	Title     string    `json:"title"`
 	Year      int32     `json:"year,omitempty"`
 	// Use the ISBN type instead of int32. Note that the omitempty directive will
@@ -23,9 +26,139 @@ type Book struct {
 	ISBN    ISBN     `json:"ISBN,omitempty"`
 	Genres  []string `json:"genres,omitempty"`
 	Version int32    `json:"version"`
+	// Cover holds the storage key of the book's cover image, and is encoded as its URL.
+	Cover Cover `json:"cover_url,omitempty"`
+	// SeriesID and SeriesPosition are set if the book belongs to a series. Positions
+	// can be fractional, so that a novella can sit between two books at 2.5.
+	SeriesID       *int64   `json:"series,omitempty"`
+	SeriesPosition *float64 `json:"series_position,omitempty"`
+	// DeletedAt is only set for books which have been moved to the trash, which are
+	// hidden from every method except GetTrash() and Restore().
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
-func ValidateBook(v *validator.Validator, book *Book) {
+// The bookColumns map translates the JSON keys of a Book into the names of the
+// corresponding database columns, and bookColumnOrder lists them in the order they
+// are selected. The created_at and updated_at columns have no JSON key, so they're only
+// selected when the client hasn't asked for specific fields.
+var (
+	bookColumns = map[string]string{
+		"id":              "id",
+		"created_at":      "created_at",
+		"updated_at":      "updated_at",
+		"title":           "title",
+		"year":            "year",
+		"ISBN":            "isbn",
+		"genres":          "genres",
+		"version":         "version",
+		"cover_url":       "cover",
+		"series":          "series_id",
+		"series_position": "series_position",
+	}
+	bookColumnOrder = []string{"id", "created_at", "updated_at", "title", "year", "ISBN", "genres", "version", "cover_url", "series", "series_position"}
+)
+
+// Return the Book fields to scan the given columns into. Note that we need to convert
+// the scan target for the genres column using the pq.Array() adapter function.
+func (b *Book) scanTargets(columns []string) []any {
+	targets := make([]any, len(columns))
+
+	for i, column := range columns {
+		switch column {
+		case "id":
+			targets[i] = &b.ID
+		case "created_at":
+			targets[i] = &b.CreatedAt
+		case "updated_at":
+			targets[i] = &b.UpdatedAt
+		case "title":
+			targets[i] = &b.Title
+		case "year":
+			targets[i] = &b.Year
+		case "isbn":
+			targets[i] = &b.ISBN
+		case "genres":
+			targets[i] = pq.Array(&b.Genres)
+		case "version":
+			targets[i] = &b.Version
+		case "cover":
+			targets[i] = &b.Cover
+		case "series_id":
+			targets[i] = &b.SeriesID
+		case "series_position":
+			targets[i] = &b.SeriesPosition
+		case "deleted_at":
+			targets[i] = &b.DeletedAt
+		default:
+			panic("unknown book column: " + column)
+		}
+	}
+
+	return targets
+}
+
+// Project returns a representation of the book for encoding to JSON which contains
+// only the fields in the fieldset. If the client didn't ask for specific fields, the
+// book itself is returned unchanged.
+func (b *Book) Project(fieldset Fieldset) any {
+	if len(fieldset.Fields) == 0 {
+		return b
+	}
+
+	projection := make(map[string]any, len(fieldset.Fields))
+
+	for _, field := range fieldset.Fields {
+		switch field {
+		case "id":
+			projection[field] = b.ID
+		case "title":
+			projection[field] = b.Title
+		case "year":
+			projection[field] = b.Year
+		case "ISBN":
+			projection[field] = b.ISBN
+		case "genres":
+			projection[field] = b.Genres
+		case "version":
+			projection[field] = b.Version
+		case "cover_url":
+			if b.Cover != "" {
+				projection[field] = b.Cover
+			}
+		case "series":
+			if b.SeriesID != nil {
+				projection[field] = b.SeriesID
+			}
+		case "series_position":
+			if b.SeriesPosition != nil {
+				projection[field] = b.SeriesPosition
+			}
+		}
+	}
+
+	return projection
+}
+
+// Return the value of the given sort column for the book. This is used to record the
+// position of the book in a keyset pagination cursor.
+func (b *Book) sortValue(column string) any {
+	switch column {
+	case "title":
+		return b.Title
+	case "year":
+		return b.Year
+	case "isbn":
+		return int32(b.ISBN)
+	default:
+		return b.ID
+	}
+}
+
+// The ValidateBook() function checks the fields of a book. If a taxonomy is given, the
+// book's genres must also be in it, and they're replaced with their canonical slugs
+// (which is done before checking for duplicates, so that aliases of the same genre
+// count as duplicates).
+func ValidateBook(v *validator.Validator, book *Book, taxonomy *Taxonomy) {
 	v.Check(book.Title != "", "title", "must be provided")
 	v.Check(len(book.Title) <= 500, "title", "must not be more than 500 bytes long")
 
@@ -39,41 +172,96 @@ func ValidateBook(v *validator.Validator, book *Book) {
 	v.Check(book.Genres != nil, "genres", "must be provided")
 	v.Check(len(book.Genres) >= 1, "genres", "must contain at least 1 genre")
 	v.Check(len(book.Genres) <= 5, "genres", "must not contain more than 5 genres")
+	if taxonomy != nil {
+		taxonomy.validateGenres(v, book)
+	}
 	v.Check(validator.Unique(book.Genres), "genres", "must not contain duplicate values")
 }
 
-// Define a BookModel struct type which wraps a sql.DB connection pool.
+// Define a BookModel struct type which wraps a sql.DB connection pool. The ctx field is
+// set by WithContext(), and is the parent of the spans recorded for each query.
 type BookModel struct {
-	DB *sql.DB
+	DB  *sql.DB
+	ctx context.Context
+}
+
+// WithContext() returns a copy of the model whose queries are traced as part of the
+// request in ctx. Only the trace is taken from ctx; each method still uses its own
+// timeout, so queries aren't cancelled just because a client went away.
+func (m BookModel) WithContext(ctx context.Context) BookModel {
+	m.ctx = ctx
+	return m
+}
+
+func (m BookModel) startSpan(name string) (context.Context, *tracing.Span) {
+	return startQuerySpan(detachedContext(m.ctx), name)
 }
 
 // The Insert() method accepts a pointer to a book struct, which should contain the
-// data for the new record.
-func (m BookModel) Insert(book *Book) error {
+// data for the new record, and the ID of the user who is creating it. The new book and
+// its first revision are inserted in a single transaction.
+func (m BookModel) Insert(book *Book, userID int64) error {
+	ctx, span := m.startSpan("BookModel.Insert")
+	defer span.End()
+
+	// Create a context with a 3-second timeout.
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := insertBook(ctx, tx, book)
+		if err != nil {
+			return err
+		}
+
+		return recordRevision(ctx, tx, RevisionCreate, nil, book, userID)
+	})
+}
+
+// The insertBook() function does the work for Insert(). It accepts a querier so that it
+// can be run either on the connection pool or inside a transaction.
+func insertBook(ctx context.Context, q querier, book *Book) error {
 	// Define the SQL query for inserting a new record in the books table and returning
 	// the system-generated data.
 	query := `
 		INSERT INTO books (title, year, isbn, genres)
 		VALUES ($1, $2, $3, $4)
-		RETURNING id, created_at, version`
+		RETURNING id, created_at, updated_at, version`
 
 	// Create an args slice containing the values for the placeholder parameters from
 	// the book struct. Declaring this slice immediately next to our SQL query helps to
 	// make it nice and clear *what values are being used where* in the query.
 	args := []any{book.Title, book.Year, book.ISBN, pq.Array(book.Genres)}
 
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
 	// Use the QueryRowContext() method and pass the context as the first argument to
-	// execute the SQL query on our connection pool, passing in the args slice as a
-	// variadic parameter and scanning the system-generated id, created_at and version
-	// values into the book struct.
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&book.ID, &book.CreatedAt, &book.Version)
+	// execute the SQL query, passing in the args slice as a variadic parameter and
+	// scanning the system-generated id, created_at, updated_at and version values into
+	// the book struct.
+	return q.QueryRowContext(ctx, query, args...).Scan(&book.ID, &book.CreatedAt, &book.UpdatedAt, &book.Version)
 }
 
 func (m BookModel) Get(id int64) (*Book, error) {
+	return m.GetFields(id, Fieldset{})
+}
+
+// The GetFields() method works like Get(), but only selects the columns needed for the
+// fields in the fieldset. The ID, updated_at and version are always selected, as they
+// are needed for the caching headers.
+func (m BookModel) GetFields(id int64, fieldset Fieldset) (*Book, error) {
+	ctx, span := m.startSpan("BookModel.GetFields")
+	defer span.End()
+
+	// Use the context.WithTimeout() function to create a context.Context which carries a
+	// 3-second timeout deadline. Note that we're using the empty context.Background()
+	// as the 'parent' context.
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return getBook(ctx, m.DB, id, fieldset)
+}
+
+// The getBook() function does the work for Get() and GetFields() on the given querier.
+func getBook(ctx context.Context, q querier, id int64, fieldset Fieldset) (*Book, error) {
 	// The PostgreSQL bigserial type that we're using for the book ID starts
 	// auto-incrementing at 1 by default, so we know that no books will have ID values
 	// less than that. To avoid making an unnecessary database call, we take a shortcut
@@ -82,34 +270,30 @@ func (m BookModel) Get(id int64) (*Book, error) {
 		return nil, ErrRecordNotFound
 	}
 
-	// Define the SQL query for retrieving the book data.
-	query := `
-		SELECT id, created_at, title, year, isbn, genres, version
+	// Work out which columns we need, and define the SQL query for retrieving the book
+	// data.
+	extra := []string{"id", "updated_at", "version"}
+
+	// Embedding the book's series needs its ID, even if the series field wasn't asked
+	// for.
+	if fieldset.Includes("series") {
+		extra = append(extra, "series_id")
+	}
+
+	columns := fieldset.columns(bookColumns, bookColumnOrder, extra...)
+
+	query := fmt.Sprintf(`
+		SELECT %s
 		FROM books
-		WHERE id = $1`
+		WHERE id = $1 AND deleted_at IS NULL`, strings.Join(columns, ", "))
 
 	// Declare a Book struct to hold the data returned by the query.
 	var book Book
 
-	// Use the context.WithTimeout() function to create a context.Context which carries a
-	// 3-second timeout deadline. Note that we're using the empty context.Background()
-	// as the 'parent' context.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
 	// Execute the query using the QueryRow() method, passing in the provided id value
 	// as a placeholder parameter, and scan the response data into the fields of the
-	// Book struct. Importantly, notice that we need to convert the scan target for the
-	// genres column using the pq.Array() adapter function again.
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
-		&book.ID,
-		&book.CreatedAt,
-		&book.Title,
-		&book.Year,
-		&book.ISBN,
-		pq.Array(&book.Genres),
-		&book.Version,
-	)
+	// Book struct which correspond to the selected columns.
+	err := q.QueryRowContext(ctx, query, id).Scan(book.scanTargets(columns)...)
 
 	// Handle any errors. If there was no matching book found, Scan() will return
 	// a sql.ErrNoRows error. We check for this and return our custom ErrRecordNotFound
@@ -127,14 +311,45 @@ func (m BookModel) Get(id int64) (*Book, error) {
 	return &book, nil
 }
 
-func (m BookModel) Update(book *Book) error {
-	// Declare the SQL query for updating the record and returning the new version
-	// number.
+// The Update() method saves the changes to a book made by the given user, and records
+// a revision containing the fields which changed.
+func (m BookModel) Update(book *Book, userID int64) error {
+	ctx, span := m.startSpan("BookModel.Update")
+	defer span.End()
+
+	// Create a context with a 3-second timeout.
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		// Lock the current version of the book so that we can work out what changed.
+		// If it has been deleted in the meantime, that's an edit conflict.
+		before, err := lockBook(ctx, tx, book.ID)
+		if err != nil {
+			if errors.Is(err, ErrRecordNotFound) {
+				return ErrEditConflict
+			}
+			return err
+		}
+
+		err = updateBook(ctx, tx, book)
+		if err != nil {
+			return err
+		}
+
+		return recordRevision(ctx, tx, RevisionUpdate, before, book, userID)
+	})
+}
+
+// The updateBook() function does the work for Update() on the given querier.
+func updateBook(ctx context.Context, q querier, book *Book) error {
+	// Declare the SQL query for updating the record and returning the new updated_at
+	// timestamp and version number.
 	query := `
 		UPDATE books
-		SET title = $1, year = $2, isbn = $3, genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
-		RETURNING version`
+		SET title = $1, year = $2, isbn = $3, genres = $4, updated_at = NOW(), version = version + 1
+		WHERE id = $5 AND version = $6 AND deleted_at IS NULL
+		RETURNING updated_at, version`
 
 	// Create an args slice containing the values for the placeholder parameters.
 	args := []any{
@@ -146,14 +361,10 @@ func (m BookModel) Update(book *Book) error {
 		book.Version,
 	}
 
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
 	// Use QueryRowContext() and pass the context as the first argument. If
 	// no matching row could be found, we know the book version has changed
 	// (or the record has been deleted) and we return our custom ErrEditConflict error.
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&book.Version)
+	err := q.QueryRowContext(ctx, query, args...).Scan(&book.UpdatedAt, &book.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -166,25 +377,67 @@ func (m BookModel) Update(book *Book) error {
 	return nil
 }
 
-func (m BookModel) Delete(id int64) error {
+// The Delete() method moves a book to the trash on behalf of the given user, and
+// records a revision for the deletion. If version isn't zero, the book is only deleted
+// if it's still at that version, and an ErrEditConflict error is returned otherwise.
+// The check is made with the book's row locked, so that it can't be changed between
+// the check and the deletion.
+func (m BookModel) Delete(id int64, version int32, userID int64) error {
+	ctx, span := m.startSpan("BookModel.Delete")
+	defer span.End()
+
+	// Create a context with a 3-second timeout.
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		before, err := lockBook(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		if version != 0 && before.Version != version {
+			return ErrEditConflict
+		}
+
+		err = deleteBook(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		return recordRevision(ctx, tx, RevisionDelete, before, deletedBook(before), userID)
+	})
+}
+
+// Return a copy of the book as it is after deleteBook() has moved it to the trash.
+func deletedBook(book *Book) *Book {
+	deleted := *book
+	now := time.Now()
+	deleted.DeletedAt = &now
+	deleted.Version++
+	return &deleted
+}
+
+// The deleteBook() function does the work for Delete() on the given querier.
+func deleteBook(ctx context.Context, q querier, id int64) error {
 	// Return an ErrRecordNotFound error if the book ID is less than 1.
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	// Construct the SQL query to delete the record.
+	// Construct the SQL query to move the record to the trash. Rather than deleting the
+	// row, we set its deleted_at timestamp so that it can be restored later. We also
+	// increment the version number, so that any in-flight updates based on the
+	// previous version will fail with an edit conflict.
 	query := `
-		DELETE FROM books
-		WHERE id = $1`
-
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+		UPDATE books
+		SET deleted_at = NOW(), updated_at = NOW(), version = version + 1
+		WHERE id = $1 AND deleted_at IS NULL`
 
 	// Execute the SQL query using the ExecContext() method and pass the context
 	// as the first argument. Passing in the id variable as the value for the
 	// placeholder parameter. The Exec() method returns a sql.Result object.
-	result, err := m.DB.ExecContext(ctx, query, id)
+	result, err := q.ExecContext(ctx, query, id)
 	if err != nil {
 		return err
 	}
@@ -197,7 +450,7 @@ func (m BookModel) Delete(id int64) error {
 	}
 
 	// If no rows were affected, we know that the books table didn't contain a record
-	// with the provided ID at the moment we tried to delete it. In that case we
+	// with the provided ID (outside of the trash) at the moment we tried to delete it. In that case we
 	// return an ErrRecordNotFound error.
 	if rowsAffected == 0 {
 		return ErrRecordNotFound
@@ -207,18 +460,42 @@ func (m BookModel) Delete(id int64) error {
 }
 
 // GetAll() method returns a slice of books.
-func (m BookModel) GetAll(title string, genres []string, filters Filters) ([]*Book, Metadata, error) {
+func (m BookModel) GetAll(title string, genres []string, filters Filters, fieldset Fieldset) ([]*Book, Metadata, error) {
+	// Only select the columns for the requested fields, plus the ID and sort column
+	// which we need to order the rows and build pagination cursors.
+	extra := []string{"id", filters.sortColumn()}
+
+	// Likewise for embedding the series of each book.
+	if fieldset.Includes("series") {
+		extra = append(extra, "series_id")
+	}
+
+	columns := fieldset.columns(bookColumns, bookColumnOrder, extra...)
+
+	// If the client sent a cursor, use keyset pagination instead of LIMIT/OFFSET.
+	cursor, err := filters.cursor()
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	if cursor != nil {
+		return m.getAllByCursor(title, genres, filters, columns, cursor)
+	}
+
 	// Construct the SQL query to retrieve all book records.
-	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, isbn, genres, version
+	query := fmt.Sprintf(`%s
+		SELECT count(*) OVER(), %s
 		FROM books
 		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		AND (genres @> $2 OR $2 = '{}')
+		AND %s
+		AND deleted_at IS NULL
 		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+		LIMIT $3 OFFSET $4`, subgenresCTE, strings.Join(columns, ", "), genresCondition, filters.sortColumn(), filters.sortDirection())
+
+	ctx, span := m.startSpan("BookModel.GetAll")
+	defer span.End()
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// Slice for placeholder parameters for the SQL query
@@ -246,18 +523,9 @@ func (m BookModel) GetAll(title string, genres []string, filters Filters) ([]*Bo
 		// Initialize an empty Book struct to hold the data for an individual book.
 		var book Book
 
-		// Scan the values from the row into the Book struct. Again, note that we're
-		// using the pq.Array() adapter on the genres field here.
-		err := rows.Scan(
-			&totalRecords, // Scan the count from the window function into totalRecords.
-			&book.ID,
-			&book.CreatedAt,
-			&book.Title,
-			&book.Year,
-			&book.ISBN,
-			pq.Array(&book.Genres),
-			&book.Version,
-		)
+		// Scan the count from the window function into totalRecords, and the values
+		// of the selected columns into the Book struct.
+		err := rows.Scan(append([]any{&totalRecords}, book.scanTargets(columns)...)...)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
@@ -276,6 +544,277 @@ func (m BookModel) GetAll(title string, genres []string, filters Filters) ([]*Bo
 	// parameters from the client.
 	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
 
+	// Also hand out cursors positioned at either end of the page, so that clients can
+	// switch over to keyset pagination from any page.
+	if len(books) > 0 {
+		if metadata.CurrentPage < metadata.LastPage {
+			last := books[len(books)-1]
+			metadata.NextCursor = filters.encodeCursor(last.sortValue(filters.sortColumn()), last.ID, false)
+		}
+		if metadata.CurrentPage > metadata.FirstPage {
+			first := books[0]
+			metadata.PrevCursor = filters.encodeCursor(first.sortValue(filters.sortColumn()), first.ID, true)
+		}
+	}
+
 	// If everything went OK, then return the slice of books along with metadata.
 	return books, metadata, nil
 }
+
+// The getAllByCursor() method returns the page of books which follows (or, when paging
+// backwards, precedes) the position recorded in the cursor. Unlike an OFFSET, the
+// keyset condition lets PostgreSQL seek straight to the right rows, and pages don't
+// shift when new books are inserted. We don't calculate a total record count here, as
+// doing so would mean scanning the whole result set again.
+func (m BookModel) getAllByCursor(title string, genres []string, filters Filters, columns []string, cursor *Cursor) ([]*Book, Metadata, error) {
+	orderBy, condition := filters.keyset(cursor, 3)
+
+	// Fetch one extra row so we know whether there is another page after this one.
+	query := fmt.Sprintf(`%s
+		SELECT %s
+		FROM books
+		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		AND %s
+		AND deleted_at IS NULL
+		AND %s
+		ORDER BY %s
+		LIMIT $5`, subgenresCTE, strings.Join(columns, ", "), genresCondition, condition, orderBy)
+
+	ctx, span := m.startSpan("BookModel.GetAll")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	args := []any{title, pq.Array(genres), cursor.Value, cursor.ID, filters.limit() + 1}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	books := []*Book{}
+
+	for rows.Next() {
+		var book Book
+
+		err := rows.Scan(book.scanTargets(columns)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		books = append(books, &book)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	// Drop the extra row if we got one.
+	hasMore := len(books) > filters.limit()
+	if hasMore {
+		books = books[:filters.limit()]
+	}
+
+	// When paging backwards the rows come back in reverse order, so flip them around
+	// before returning them to the client.
+	if cursor.Backward {
+		for i, j := 0, len(books)-1; i < j; i, j = i+1, j-1 {
+			books[i], books[j] = books[j], books[i]
+		}
+	}
+
+	metadata := Metadata{PageSize: filters.PageSize}
+
+	if len(books) > 0 {
+		first, last := books[0], books[len(books)-1]
+		column := filters.sortColumn()
+
+		// There are always rows on the side of the page we came from. On the other
+		// side, there are only more rows if the extra row was returned.
+		if !cursor.Backward || hasMore {
+			metadata.PrevCursor = filters.encodeCursor(first.sortValue(column), first.ID, true)
+		}
+		if cursor.Backward || hasMore {
+			metadata.NextCursor = filters.encodeCursor(last.sortValue(column), last.ID, false)
+		}
+	}
+
+	return books, metadata, nil
+}
+
+// Define the possible outcomes for a book passed to the Import() method, and the
+// policies for handling books which share an ISBN with an existing record.
+const (
+	ImportCreated  = "created"
+	ImportUpdated  = "updated"
+	ImportSkipped  = "skipped"
+	ImportConflict = "conflict"
+
+	OnConflictError  = "error"
+	OnConflictSkip   = "skip"
+	OnConflictUpdate = "update"
+)
+
+// The time that the Import() method allows for each book, on top of a 10-second minimum.
+// Several statements run for every book, so a large import takes far longer than the
+// usual 3-second timeout.
+const importTimeoutPerBook = 20 * time.Millisecond
+
+// errDryRun is returned inside the Import() transaction to roll it back after a dry
+// run.
+var errDryRun = errors.New("dry run")
+
+// The Import() method inserts a large number of (already validated) books in a single
+// transaction, and returns the outcome for each book in a slice which lines up with
+// the books slice. If a book has the same ISBN as an existing record, the onConflict
+// policy decides whether it is reported as a conflict, skipped, or used to update the
+// existing record. Running everything in one transaction means that either all of the
+// books are imported or none are, and that a book sees any earlier book in the import
+// with the same ISBN. When dryRun is true the transaction is rolled back, so the
+// outcomes can be reported without changing any data.
+func (m BookModel) Import(books []*Book, onConflict string, dryRun bool, userID int64) ([]string, error) {
+	ctx, span := m.startSpan("BookModel.Import")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second+time.Duration(len(books))*importTimeoutPerBook)
+	defer cancel()
+
+	outcomes := make([]string, len(books))
+
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		// Prepare the statements once for the whole import. Conflicts are detected by
+		// looking for an existing book with the same ISBN, locking it so that it can't
+		// change before we update it.
+		findStmt, err := tx.PrepareContext(ctx, `
+			SELECT id, created_at, title, year, isbn, genres, version
+			FROM books
+			WHERE isbn = $1 AND deleted_at IS NULL
+			ORDER BY id
+			LIMIT 1
+			FOR UPDATE`)
+		if err != nil {
+			return err
+		}
+		defer findStmt.Close()
+
+		insertStmt, err := tx.PrepareContext(ctx, `
+			INSERT INTO books (title, year, isbn, genres)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id, created_at, updated_at, version`)
+		if err != nil {
+			return err
+		}
+		defer insertStmt.Close()
+
+		updateStmt, err := tx.PrepareContext(ctx, `
+			UPDATE books
+			SET title = $1, year = $2, isbn = $3, genres = $4, updated_at = NOW(), version = version + 1
+			WHERE id = $5
+			RETURNING created_at, updated_at, version`)
+		if err != nil {
+			return err
+		}
+		defer updateStmt.Close()
+
+		for i, book := range books {
+			args := []any{book.Title, book.Year, book.ISBN, pq.Array(book.Genres)}
+
+			var existing Book
+
+			err := findStmt.QueryRowContext(ctx, book.ISBN).Scan(
+				&existing.ID,
+				&existing.CreatedAt,
+				&existing.Title,
+				&existing.Year,
+				&existing.ISBN,
+				pq.Array(&existing.Genres),
+				&existing.Version,
+			)
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				err = insertStmt.QueryRowContext(ctx, args...).Scan(&book.ID, &book.CreatedAt, &book.UpdatedAt, &book.Version)
+				if err == nil {
+					err = recordRevision(ctx, tx, RevisionCreate, nil, book, userID)
+				}
+				outcomes[i] = ImportCreated
+			case err != nil:
+				return err
+			case onConflict == OnConflictUpdate:
+				book.ID = existing.ID
+				err = updateStmt.QueryRowContext(ctx, append(args, existing.ID)...).Scan(&book.CreatedAt, &book.UpdatedAt, &book.Version)
+				if err == nil {
+					err = recordRevision(ctx, tx, RevisionUpdate, &existing, book, userID)
+				}
+				outcomes[i] = ImportUpdated
+			case onConflict == OnConflictSkip:
+				book.ID = existing.ID
+				outcomes[i] = ImportSkipped
+			default:
+				outcomes[i] = ImportConflict
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+
+	return outcomes, nil
+}
+
+// The Export() method streams every book matching the title, genres and sort order in
+// the filters (pagination is ignored), calling fn for each book as it is read from the
+// database rather than collecting them all in memory first. The query runs with the
+// provided context, so it is cancelled as soon as ctx is done, and any error returned
+// by fn stops the export.
+func (m BookModel) Export(ctx context.Context, title string, genres []string, filters Filters, fn func(*Book) error) error {
+	ctx, span := startQuerySpan(ctx, "BookModel.Export")
+	defer span.End()
+
+	query := fmt.Sprintf(`%s
+		SELECT id, created_at, title, year, isbn, genres, version
+		FROM books
+		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		AND %s
+		AND deleted_at IS NULL
+		ORDER BY %s %s, id ASC`, subgenresCTE, genresCondition, filters.sortColumn(), filters.sortDirection())
+
+	rows, err := m.DB.QueryContext(ctx, query, title, pq.Array(genres))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var book Book
+
+		err := rows.Scan(
+			&book.ID,
+			&book.CreatedAt,
+			&book.Title,
+			&book.Year,
+			&book.ISBN,
+			pq.Array(&book.Genres),
+			&book.Version,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&book)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,41 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// The SetCover() method replaces the cover of a book, or removes it if cover is empty.
+// Like Update(), this uses the version number of the book for optimistic concurrency
+// control and increments it, so that cached copies of the book (and their ETags) are
+// invalidated. Covers aren't part of the book's revision history though, as the old
+// images are deleted once they've been replaced.
+func (m BookModel) SetCover(book *Book, cover Cover) error {
+	query := `
+		UPDATE books
+		SET cover = $1, updated_at = NOW(), version = version + 1
+		WHERE id = $2 AND version = $3 AND deleted_at IS NULL
+		RETURNING updated_at, version`
+
+	ctx, span := m.startSpan("BookModel.SetCover")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, cover, book.ID, book.Version).Scan(&book.UpdatedAt, &book.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	book.Cover = cover
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package data
+
+import (
+	"bookworm.onatim.com/internal/validator"
+)
+
+// A Fieldset holds the fields of a record that the client has asked for (through the
+// fields query string parameter), and the names of any related data that they want
+// embedded in the response (through the include query string parameter). Like the sort
+// value in Filters, both are checked against safelists before they are used.
+type Fieldset struct {
+	Fields          []string
+	FieldSafelist   []string
+	Include         []string
+	IncludeSafelist []string
+}
+
+func ValidateFieldset(v *validator.Validator, f Fieldset) {
+	// Check that each requested field and relation matches a value in the safelist.
+	for _, field := range f.Fields {
+		v.Check(validator.PermittedValue(field, f.FieldSafelist...), "fields", "invalid field value "+field)
+	}
+	v.Check(validator.Unique(f.Fields), "fields", "must not contain duplicate values")
+
+	for _, include := range f.Include {
+		v.Check(validator.PermittedValue(include, f.IncludeSafelist...), "include", "invalid include value "+include)
+	}
+	v.Check(validator.Unique(f.Include), "include", "must not contain duplicate values")
+}
+
+// Has returns true if the given field should appear in the response. When the client
+// didn't ask for specific fields, all of them are returned.
+func (f Fieldset) Has(field string) bool {
+	if len(f.Fields) == 0 {
+		return true
+	}
+
+	return validator.PermittedValue(field, f.Fields...)
+}
+
+// Includes returns true if the client asked for the named related data to be embedded
+// in the response.
+func (f Fieldset) Includes(name string) bool {
+	return validator.PermittedValue(name, f.Include...)
+}
+
+// Return the names of the columns to select for the requested fields, using the
+// columns map to translate JSON keys into column names. Any extra columns (such as the
+// ID and sort column needed for pagination) are always selected.
+func (f Fieldset) columns(columns map[string]string, order []string, extra ...string) []string {
+	selected := []string{}
+
+	for _, field := range order {
+		column := columns[field]
+		if f.Has(field) || validator.PermittedValue(column, extra...) {
+			selected = append(selected, column)
+		}
+	}
+
+	return selected
+}
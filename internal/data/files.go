@@ -0,0 +1,233 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"bookworm.onatim.com/internal/tracing"
+)
+
+// The FileFormats map holds the ebook formats which can be attached to a book, along
+// with the content type that each format is served with.
+var FileFormats = map[string]string{
+	"epub": "application/epub+zip",
+	"pdf":  "application/pdf",
+}
+
+// A BookFile is an ebook file attached to a book. A book can have one file of each
+// format. The file itself is kept in storage under Key, and Checksum holds the
+// hex-encoded SHA-256 hash of its contents.
+type BookFile struct {
+	ID        int64     `json:"-"`
+	BookID    int64     `json:"book_id"`
+	Format    string    `json:"format"`
+	Key       string    `json:"-"`
+	Size      int64     `json:"size"`
+	Checksum  string    `json:"checksum"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Define the BookFileModel type. Like BookModel, the ctx field is set by WithContext()
+// to trace queries as part of a request.
+type BookFileModel struct {
+	DB  *sql.DB
+	ctx context.Context
+}
+
+// WithContext() returns a copy of the model whose queries are traced as part of the
+// request in ctx.
+func (m BookFileModel) WithContext(ctx context.Context) BookFileModel {
+	m.ctx = ctx
+	return m
+}
+
+func (m BookFileModel) startSpan(name string) (context.Context, *tracing.Span) {
+	return startQuerySpan(detachedContext(m.ctx), name)
+}
+
+// The Put() method attaches a file to a book, replacing any existing file of the same
+// format. It returns the storage key of the file which was replaced (or an empty
+// string if there wasn't one), so that the caller can delete it. If the book doesn't
+// exist or is in the trash, ErrRecordNotFound is returned.
+func (m BookFileModel) Put(file *BookFile) (string, error) {
+	ctx, span := m.startSpan("BookFileModel.Put")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var previous string
+
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		// Lock the book so that it can't be moved to the trash while we attach the file.
+		query := `
+			SELECT id
+			FROM books
+			WHERE id = $1 AND deleted_at IS NULL
+			FOR SHARE`
+
+		err := tx.QueryRowContext(ctx, query, file.BookID).Scan(&file.BookID)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+
+		query = `
+			SELECT key
+			FROM book_files
+			WHERE book_id = $1 AND format = $2
+			FOR UPDATE`
+
+		err = tx.QueryRowContext(ctx, query, file.BookID, file.Format).Scan(&previous)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		query = `
+			INSERT INTO book_files (book_id, format, key, size, checksum)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (book_id, format) DO UPDATE
+			SET key = EXCLUDED.key, size = EXCLUDED.size, checksum = EXCLUDED.checksum, created_at = NOW()
+			RETURNING id, created_at`
+
+		args := []any{file.BookID, file.Format, file.Key, file.Size, file.Checksum}
+
+		return tx.QueryRowContext(ctx, query, args...).Scan(&file.ID, &file.CreatedAt)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return previous, nil
+}
+
+// The Get() method returns the file of the given format attached to a book. If the book
+// doesn't have one, or is in the trash, ErrRecordNotFound is returned.
+func (m BookFileModel) Get(bookID int64, format string) (*BookFile, error) {
+	if bookID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT book_files.id, book_files.book_id, book_files.format, book_files.key,
+			book_files.size, book_files.checksum, book_files.created_at
+		FROM book_files
+		INNER JOIN books ON books.id = book_files.book_id
+		WHERE book_files.book_id = $1 AND book_files.format = $2 AND books.deleted_at IS NULL`
+
+	ctx, span := m.startSpan("BookFileModel.Get")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var file BookFile
+
+	err := m.DB.QueryRowContext(ctx, query, bookID, format).Scan(
+		&file.ID,
+		&file.BookID,
+		&file.Format,
+		&file.Key,
+		&file.Size,
+		&file.Checksum,
+		&file.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &file, nil
+}
+
+// The GetAllForBook() method returns all the files attached to a book.
+func (m BookFileModel) GetAllForBook(bookID int64) ([]*BookFile, error) {
+	query := `
+		SELECT id, book_id, format, key, size, checksum, created_at
+		FROM book_files
+		WHERE book_id = $1
+		ORDER BY format`
+
+	ctx, span := m.startSpan("BookFileModel.GetAllForBook")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []*BookFile{}
+
+	for rows.Next() {
+		var file BookFile
+
+		err := rows.Scan(
+			&file.ID,
+			&file.BookID,
+			&file.Format,
+			&file.Key,
+			&file.Size,
+			&file.Checksum,
+			&file.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, &file)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// The Delete() method removes the file of the given format from a book, and returns its
+// storage key so that the caller can delete it. If the book doesn't have one, or is in
+// the trash, ErrRecordNotFound is returned.
+func (m BookFileModel) Delete(bookID int64, format string) (string, error) {
+	if bookID < 1 {
+		return "", ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM book_files
+		USING books
+		WHERE books.id = book_files.book_id AND book_files.book_id = $1 AND book_files.format = $2 AND books.deleted_at IS NULL
+		RETURNING book_files.key`
+
+	ctx, span := m.startSpan("BookFileModel.Delete")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var key string
+
+	err := m.DB.QueryRowContext(ctx, query, bookID, format).Scan(&key)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+
+	return key, nil
+}
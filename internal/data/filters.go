@@ -1,6 +1,7 @@
 package data
 
 import (
+	"fmt"
 	"math"
 	"strings"
 
@@ -12,6 +13,11 @@ type Filters struct {
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+	// Cursor holds the opaque cursor string sent by the client for keyset
+	// pagination, and CursorSecret the key used to sign and verify it. When Cursor
+	// is empty we fall back to the Page and PageSize based offset pagination.
+	Cursor       string
+	CursorSecret []byte
 }
 
 func ValidateFilters(v *validator.Validator, f Filters) {
@@ -23,6 +29,36 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 
 	// Check that the sort parameter matches a value in the safelist.
 	v.Check(validator.PermittedValue(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+
+	// If a cursor was provided, check that it has a valid signature and that it was
+	// created for the same sort order as the current request.
+	if f.Cursor != "" {
+		c, err := f.cursor()
+		v.Check(err == nil, "cursor", "invalid cursor")
+		v.Check(err != nil || c.Sort == f.Sort, "cursor", "does not match the sort value")
+	}
+}
+
+// Return the decoded cursor for keyset pagination, or nil if no cursor was provided.
+func (f Filters) cursor() (*Cursor, error) {
+	if f.Cursor == "" {
+		return nil, nil
+	}
+
+	return DecodeCursor(f.CursorSecret, f.Cursor)
+}
+
+// Return a new cursor positioned at the given row, encoded and signed ready to be sent
+// to the client.
+func (f Filters) encodeCursor(value any, id int64, backward bool) string {
+	c := Cursor{
+		Sort:     f.Sort,
+		Value:    fmt.Sprint(value),
+		ID:       id,
+		Backward: backward,
+	}
+
+	return c.Encode(f.CursorSecret)
 }
 
 // Check that the client-provided Sort field matches one of the entries in our safelist
@@ -48,6 +84,50 @@ func (f Filters) sortDirection() string {
 	return "ASC"
 }
 
+// Return the ORDER BY clause and the keyset WHERE condition for seeking past the
+// position held in the cursor c. The sort column value and ID are expected in the
+// placeholder parameters $valuePos and $valuePos+1.
+//
+// Rows are always ordered by the sort column first and then by ascending ID, so a row
+// comes after the cursor if its sort value is beyond the cursor value, or if the sort
+// values are equal and its ID is greater. When paging backwards we flip every
+// comparison and sort direction, and the caller reverses the rows afterwards.
+func (f Filters) keyset(c *Cursor, valuePos int) (orderBy, condition string) {
+	column := f.sortColumn()
+
+	valueCmp, idCmp := ">", ">"
+	valueDir, idDir := "ASC", "ASC"
+
+	if f.sortDirection() == "DESC" {
+		valueCmp, valueDir = "<", "DESC"
+	}
+
+	if c.Backward {
+		valueCmp, idCmp = flipComparison(valueCmp), flipComparison(idCmp)
+		valueDir, idDir = flipDirection(valueDir), flipDirection(idDir)
+	}
+
+	orderBy = fmt.Sprintf("%s %s, id %s", column, valueDir, idDir)
+	condition = fmt.Sprintf("(%[1]s %[2]s $%[4]d OR (%[1]s = $%[4]d AND id %[3]s $%[5]d))",
+		column, valueCmp, idCmp, valuePos, valuePos+1)
+
+	return orderBy, condition
+}
+
+func flipComparison(cmp string) string {
+	if cmp == ">" {
+		return "<"
+	}
+	return ">"
+}
+
+func flipDirection(dir string) string {
+	if dir == "ASC" {
+		return "DESC"
+	}
+	return "ASC"
+}
+
 func (f Filters) limit() int {
 	return f.PageSize
 }
@@ -63,6 +143,10 @@ type Metadata struct {
 	FirstPage    int `json:"first_page,omitempty"`
 	LastPage     int `json:"last_page,omitempty"`
 	TotalRecords int `json:"total_records,omitempty"`
+	// The cursors are only set when there are more records to fetch in that
+	// direction. They can be passed back in the cursor query string parameter.
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
 }
 
 // The calculateMetadata() function calculates the appropriate pagination metadata
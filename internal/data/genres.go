@@ -0,0 +1,550 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"bookworm.onatim.com/internal/tracing"
+	"bookworm.onatim.com/internal/validator"
+	"github.com/lib/pq"
+)
+
+// Define custom errors for the genre model.
+var (
+	ErrDuplicateGenre = errors.New("duplicate genre")
+	ErrGenreInUse     = errors.New("genre in use")
+)
+
+// A Genre is an entry in the genre taxonomy. Books store the slugs of their genres, and
+// anything which matches one of a genre's aliases (or its name) is treated as that
+// genre. Genres can have a parent, so that filtering books by a genre also finds books
+// in its sub-genres.
+type Genre struct {
+	ID        int64    `json:"id"`
+	Slug      string   `json:"slug"`
+	Name      string   `json:"name"`
+	ParentID  int64    `json:"-"`
+	Parent    string   `json:"parent,omitempty"`
+	Aliases   []string `json:"aliases"`
+	BookCount int64    `json:"book_count"`
+	Version   int32    `json:"version"`
+}
+
+var slugRX = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+// The Slugify() function converts a genre name into its slug, by lowercasing it and
+// replacing every run of characters other than letters and digits with a hyphen. So
+// "Sci-Fi", "sci fi" and "SCI_FI" all have the slug "sci-fi". Letters and digits in any
+// script are kept, so "Ciencia Ficción" becomes "ciencia-ficción" rather than losing
+// its accent.
+func Slugify(s string) string {
+	return strings.Trim(slugRX.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+func ValidateGenre(v *validator.Validator, genre *Genre) {
+	v.Check(genre.Name != "", "name", "must be provided")
+	v.Check(len(genre.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(genre.Slug != "", "slug", "must contain at least one letter or digit")
+	v.Check(len(genre.Slug) <= 100, "slug", "must not be more than 100 bytes long")
+
+	v.Check(genre.Parent != genre.Slug, "parent", "must not be the genre itself")
+
+	v.Check(len(genre.Aliases) <= 20, "aliases", "must not contain more than 20 aliases")
+	v.Check(validator.Unique(genre.Aliases), "aliases", "must not contain duplicate values")
+
+	for _, alias := range genre.Aliases {
+		v.Check(alias != "", "aliases", "must contain at least one letter or digit in each alias")
+		v.Check(alias != genre.Slug, "aliases", "must not contain the genre's own slug")
+	}
+}
+
+// A Taxonomy is a snapshot of all the genres, which is used to resolve the genres that
+// clients send into their canonical slugs.
+type Taxonomy struct {
+	genres map[string]*Genre
+	byID   map[int64]*Genre
+	lookup map[string]string
+}
+
+// The Resolve() method returns the slug of the genre with the given slug, name or
+// alias, compared after slugifying. If there's no such genre, it returns false.
+func (t *Taxonomy) Resolve(name string) (string, bool) {
+	slug, ok := t.lookup[Slugify(name)]
+	return slug, ok
+}
+
+// The Normalize() method resolves a list of genres into their slugs, removing any
+// duplicates. Genres which can't be resolved are slugified and kept, so that they
+// won't match any book rather than being silently dropped.
+func (t *Taxonomy) Normalize(names []string) []string {
+	slugs := []string{}
+
+	for _, name := range names {
+		slug, ok := t.Resolve(name)
+		if !ok {
+			slug = Slugify(name)
+		}
+		if !validator.PermittedValue(slug, slugs...) {
+			slugs = append(slugs, slug)
+		}
+	}
+
+	return slugs
+}
+
+// The Get() method returns the genre with the given slug, or nil if there isn't one.
+func (t *Taxonomy) Get(slug string) *Genre {
+	return t.genres[slug]
+}
+
+// The IsAncestor() method reports whether the genre with the ancestor slug is the
+// parent of the genre with the given slug, or the parent of its parent, and so on.
+func (t *Taxonomy) IsAncestor(ancestor, slug string) bool {
+	genre := t.genres[slug]
+
+	// Limit the number of steps, in case the hierarchy somehow contains a cycle.
+	for i := 0; genre != nil && i < len(t.genres); i++ {
+		genre = t.byID[genre.ParentID]
+		if genre != nil && genre.Slug == ancestor {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The validateGenres() method is used by ValidateBook() to check that each of the
+// book's genres is in the taxonomy, replacing them with their slugs as it goes.
+func (t *Taxonomy) validateGenres(v *validator.Validator, book *Book) {
+	for i, genre := range book.Genres {
+		slug, ok := t.Resolve(genre)
+		if !ok {
+			v.AddError("genres", fmt.Sprintf("contains unknown genre %q", genre))
+			continue
+		}
+		book.Genres[i] = slug
+	}
+}
+
+// The subgenresCTE and genresCondition are used together to filter books by genre,
+// where the $2 parameter holds the slugs of the genres to filter by. The CTE finds every
+// requested genre and all of its descendants, labelled with the requested genre they
+// belong to. The condition then checks that the book has a genre belonging to each of
+// the requested genres, so filtering by "fantasy" also finds "urban-fantasy" books.
+// The count has to be done per book, so it's preceded by an overlap check against all
+// the matching slugs, which can use the GIN index on books.genres to skip books with
+// none of them. When $2 is empty, both checks are skipped and every book matches.
+const (
+	subgenresCTE = `
+		WITH RECURSIVE subgenres AS (
+			SELECT slug AS root, id, slug
+			FROM genres
+			WHERE slug = ANY($2)
+			UNION ALL
+			SELECT subgenres.root, genres.id, genres.slug
+			FROM genres
+			INNER JOIN subgenres ON genres.parent_id = subgenres.id
+		)`
+	genresCondition = `(cardinality($2::text[]) = 0 OR (
+		books.genres && ARRAY(SELECT slug FROM subgenres) AND
+		(SELECT count(DISTINCT root) FROM subgenres WHERE slug = ANY(books.genres)) = cardinality($2::text[])))`
+)
+
+// Define the GenreModel type. Like BookModel, the ctx field is set by WithContext()
+// to trace queries as part of a request.
+type GenreModel struct {
+	DB  *sql.DB
+	ctx context.Context
+}
+
+// WithContext() returns a copy of the model whose queries are traced as part of the
+// request in ctx.
+func (m GenreModel) WithContext(ctx context.Context) GenreModel {
+	m.ctx = ctx
+	return m
+}
+
+func (m GenreModel) startSpan(name string) (context.Context, *tracing.Span) {
+	return startQuerySpan(detachedContext(m.ctx), name)
+}
+
+// The Taxonomy() method loads a snapshot of all the genres.
+func (m GenreModel) Taxonomy() (*Taxonomy, error) {
+	ctx, span := m.startSpan("GenreModel.Taxonomy")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return getTaxonomy(ctx, m.DB)
+}
+
+func getTaxonomy(ctx context.Context, q querier) (*Taxonomy, error) {
+	query := `
+		SELECT id, slug, name, COALESCE(parent_id, 0),
+			ARRAY(SELECT alias FROM genre_aliases WHERE genre_id = genres.id ORDER BY alias)
+		FROM genres`
+
+	rows, err := q.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	t := &Taxonomy{
+		genres: make(map[string]*Genre),
+		byID:   make(map[int64]*Genre),
+		lookup: make(map[string]string),
+	}
+
+	for rows.Next() {
+		var genre Genre
+
+		err := rows.Scan(&genre.ID, &genre.Slug, &genre.Name, &genre.ParentID, pq.Array(&genre.Aliases))
+		if err != nil {
+			return nil, err
+		}
+
+		t.genres[genre.Slug] = &genre
+		t.byID[genre.ID] = &genre
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Build the lookup table. Names and aliases are added first, so that if one of
+	// them happens to slugify to another genre's slug, the slug wins.
+	for _, genre := range t.genres {
+		t.lookup[Slugify(genre.Name)] = genre.Slug
+		for _, alias := range genre.Aliases {
+			t.lookup[alias] = genre.Slug
+		}
+	}
+	for _, genre := range t.genres {
+		t.lookup[genre.Slug] = genre.Slug
+		if parent := t.byID[genre.ParentID]; parent != nil {
+			genre.Parent = parent.Slug
+		}
+	}
+
+	return t, nil
+}
+
+// The genreQuery selects genres along with the number of books in each genre or any of
+// its sub-genres, not counting books in the trash. The %s verb is for the WHERE clause.
+const genreQuery = `
+	WITH RECURSIVE subgenres AS (
+		SELECT id AS root, id, slug
+		FROM genres
+		UNION ALL
+		SELECT subgenres.root, genres.id, genres.slug
+		FROM genres
+		INNER JOIN subgenres ON genres.parent_id = subgenres.id
+	)
+	SELECT genres.id, genres.slug, genres.name, COALESCE(genres.parent_id, 0), COALESCE(parent.slug, ''),
+		ARRAY(SELECT alias FROM genre_aliases WHERE genre_id = genres.id ORDER BY alias),
+		(SELECT count(*) FROM books WHERE books.deleted_at IS NULL AND books.genres && ARRAY(SELECT slug FROM subgenres WHERE root = genres.id)),
+		genres.version
+	FROM genres
+	LEFT JOIN genres AS parent ON parent.id = genres.parent_id
+	%s
+	ORDER BY genres.slug`
+
+func (g *Genre) scan(row interface{ Scan(...any) error }) error {
+	return row.Scan(&g.ID, &g.Slug, &g.Name, &g.ParentID, &g.Parent, pq.Array(&g.Aliases), &g.BookCount, &g.Version)
+}
+
+// The GetAll() method returns all the genres, optionally limited to the direct
+// children of the genre with the parent slug.
+func (m GenreModel) GetAll(parent string) ([]*Genre, error) {
+	query := fmt.Sprintf(genreQuery, `WHERE (parent.slug = $1 OR $1 = '')`)
+
+	ctx, span := m.startSpan("GenreModel.GetAll")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, parent)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	genres := []*Genre{}
+
+	for rows.Next() {
+		var genre Genre
+
+		err := genre.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		genres = append(genres, &genre)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return genres, nil
+}
+
+// The Get() method returns the genre with the given slug.
+func (m GenreModel) Get(slug string) (*Genre, error) {
+	query := fmt.Sprintf(genreQuery, `WHERE genres.slug = $1`)
+
+	ctx, span := m.startSpan("GenreModel.Get")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var genre Genre
+
+	err := genre.scan(m.DB.QueryRowContext(ctx, query, slug))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &genre, nil
+}
+
+// The Insert() method adds a new genre along with its aliases. If the slug or one of
+// the aliases is already taken, ErrDuplicateGenre is returned.
+func (m GenreModel) Insert(genre *Genre) error {
+	query := `
+		INSERT INTO genres (slug, name, parent_id)
+		VALUES ($1, $2, NULLIF($3, 0))
+		RETURNING id, version`
+
+	ctx, span := m.startSpan("GenreModel.Insert")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, genre.Slug, genre.Name, genre.ParentID).Scan(&genre.ID, &genre.Version)
+		if err != nil {
+			return duplicateGenreError(err)
+		}
+
+		return setAliases(ctx, tx, genre)
+	})
+}
+
+// The Update() method saves changes to the name, parent and aliases of a genre, using
+// its version number for optimistic concurrency control. The slug can't be changed, as
+// it's stored in the books.
+func (m GenreModel) Update(genre *Genre) error {
+	query := `
+		UPDATE genres
+		SET name = $1, parent_id = NULLIF($2, 0), version = version + 1
+		WHERE id = $3 AND version = $4
+		RETURNING version`
+
+	ctx, span := m.startSpan("GenreModel.Update")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, genre.Name, genre.ParentID, genre.ID, genre.Version).Scan(&genre.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return err
+			}
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM genre_aliases WHERE genre_id = $1`, genre.ID)
+		if err != nil {
+			return err
+		}
+
+		return setAliases(ctx, tx, genre)
+	})
+}
+
+// The Delete() method deletes the genre with the given slug. Its sub-genres are moved
+// up to its parent. If any book (including those in the trash) still has the genre,
+// ErrGenreInUse is returned.
+func (m GenreModel) Delete(slug string) error {
+	ctx, span := m.startSpan("GenreModel.Delete")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		var id, parentID int64
+		var inUse bool
+
+		query := `
+			SELECT id, COALESCE(parent_id, 0), EXISTS(SELECT 1 FROM books WHERE $1 = ANY(genres))
+			FROM genres
+			WHERE slug = $1
+			FOR UPDATE`
+
+		err := tx.QueryRowContext(ctx, query, slug).Scan(&id, &parentID, &inUse)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+
+		if inUse {
+			return ErrGenreInUse
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE genres SET parent_id = NULLIF($1, 0), version = version + 1 WHERE parent_id = $2`, parentID, id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM genres WHERE id = $1`, id)
+		return err
+	})
+}
+
+// The Merge() method merges the genre with the source slug into the target genre, for
+// when the same genre has ended up in the taxonomy twice. The source genre is replaced
+// by the target in every book (including those in the trash), with a revision recorded
+// for each of them. The source's slug and aliases become aliases of the target, so that
+// they still resolve to it, and its sub-genres are moved under the target. Finally the
+// source genre is deleted.
+func (m GenreModel) Merge(source, target string, userID int64) error {
+	ctx, span := m.startSpan("GenreModel.Merge")
+	defer span.End()
+
+	// A lot of books may need to be updated, so allow longer than usual.
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		var sourceID, targetID int64
+
+		query := `
+			SELECT
+				COALESCE((SELECT id FROM genres WHERE slug = $1 FOR UPDATE), 0),
+				COALESCE((SELECT id FROM genres WHERE slug = $2 FOR UPDATE), 0)`
+
+		err := tx.QueryRowContext(ctx, query, source, target).Scan(&sourceID, &targetID)
+		if err != nil {
+			return err
+		}
+
+		if sourceID == 0 || targetID == 0 {
+			return ErrRecordNotFound
+		}
+
+		// Replace the source genre with the target in each book, or just remove it if
+		// the book already has the target genre.
+		query = `
+			WITH old AS (
+				SELECT id, genres
+				FROM books
+				WHERE $1 = ANY(genres)
+				FOR UPDATE
+			)
+			UPDATE books
+			SET genres = CASE WHEN $2 = ANY(old.genres) THEN array_remove(old.genres, $1) ELSE array_replace(old.genres, $1, $2) END,
+				updated_at = NOW(), version = books.version + 1
+			FROM old
+			WHERE books.id = old.id
+			RETURNING books.id, books.title, books.year, books.isbn, old.genres, books.genres, books.version, books.deleted_at`
+
+		rows, err := tx.QueryContext(ctx, query, source, target)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		var changed [][2]*Book
+
+		for rows.Next() {
+			var before, after Book
+
+			err := rows.Scan(&after.ID, &after.Title, &after.Year, &after.ISBN, pq.Array(&before.Genres), pq.Array(&after.Genres), &after.Version, &after.DeletedAt)
+			if err != nil {
+				return err
+			}
+
+			before.Title, before.Year, before.ISBN, before.DeletedAt = after.Title, after.Year, after.ISBN, after.DeletedAt
+
+			changed = append(changed, [2]*Book{&before, &after})
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for _, books := range changed {
+			err := recordRevision(ctx, tx, RevisionUpdate, books[0], books[1], userID)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE genre_aliases SET genre_id = $1 WHERE genre_id = $2`, targetID, sourceID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO genre_aliases (alias, genre_id) VALUES ($1, $2)`, source, targetID)
+		if err != nil {
+			return duplicateGenreError(err)
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE genres SET parent_id = $1, version = version + 1 WHERE parent_id = $2`, targetID, sourceID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE genres SET version = version + 1 WHERE id = $1`, targetID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM genres WHERE id = $1`, sourceID)
+		return err
+	})
+}
+
+func setAliases(ctx context.Context, tx *sql.Tx, genre *Genre) error {
+	query := `
+		INSERT INTO genre_aliases (alias, genre_id)
+		SELECT unnest($1::text[]), $2`
+
+	_, err := tx.ExecContext(ctx, query, pq.Array(genre.Aliases), genre.ID)
+	return duplicateGenreError(err)
+}
+
+// Convert unique constraint violations on the genre slug or aliases into
+// ErrDuplicateGenre.
+func duplicateGenreError(err error) error {
+	var pqErr *pq.Error
+
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrDuplicateGenre
+	}
+
+	return err
+}
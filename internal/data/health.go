@@ -0,0 +1,22 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Define the HealthModel type, which the readiness healthcheck uses to check that the
+// database is usable.
+type HealthModel struct {
+	DB *sql.DB
+}
+
+// The Ping() method checks that a connection to the database can be made and used.
+func (m HealthModel) Ping(ctx context.Context) error {
+	return m.DB.PingContext(ctx)
+}
+
+// The Stats() method returns the statistics of the database connection pool.
+func (m HealthModel) Stats() sql.DBStats {
+	return m.DB.Stats()
+}
@@ -0,0 +1,144 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// An IdempotencyRecord holds the response which was sent for the first request made with
+// a particular idempotency key, so that it can be replayed if the request is retried.
+// While the first request is still being processed, StatusCode is zero.
+type IdempotencyRecord struct {
+	UserID      int64
+	Key         string
+	RequestHash []byte
+	StatusCode  int
+	Header      map[string][]string
+	Body        []byte
+	Expiry      time.Time
+}
+
+// Define the IdempotencyModel type.
+type IdempotencyModel struct {
+	DB *sql.DB
+}
+
+// The Reserve() method claims an idempotency key for a user, recording the hash of the
+// request payload it's being used with. If the key is free (or its previous record has
+// expired), it returns true and the caller should go on to process the request.
+// Otherwise it returns false along with the existing record, so the caller can replay
+// or reject the request.
+func (m IdempotencyModel) Reserve(userID int64, key string, requestHash []byte, ttl time.Duration) (bool, *IdempotencyRecord, error) {
+	// Insert a new record for the key, or take over an existing one if it has expired.
+	// The RETURNING clause only returns a row if one of these happened.
+	query := `
+		INSERT INTO idempotency_keys (user_id, key, request_hash, expiry)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, status_code = NULL, header = NULL, body = NULL, expiry = EXCLUDED.expiry
+		WHERE idempotency_keys.expiry < NOW()
+		RETURNING user_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int64
+
+	err := m.DB.QueryRowContext(ctx, query, userID, key, requestHash, time.Now().Add(ttl)).Scan(&id)
+	switch {
+	case err == nil:
+		return true, nil, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return false, nil, err
+	}
+
+	// The key is already in use, so fetch the existing record.
+	query = `
+		SELECT user_id, key, request_hash, COALESCE(status_code, 0), header, body, expiry
+		FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2`
+
+	var record IdempotencyRecord
+	var header []byte
+
+	err = m.DB.QueryRowContext(ctx, query, userID, key).Scan(
+		&record.UserID,
+		&record.Key,
+		&record.RequestHash,
+		&record.StatusCode,
+		&header,
+		&record.Body,
+		&record.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil, ErrRecordNotFound
+		default:
+			return false, nil, err
+		}
+	}
+
+	if header != nil {
+		err = json.Unmarshal(header, &record.Header)
+		if err != nil {
+			return false, nil, err
+		}
+	}
+
+	return false, &record, nil
+}
+
+// The Complete() method stores the response for a reserved idempotency key.
+func (m IdempotencyModel) Complete(userID int64, key string, statusCode int, header map[string][]string, body []byte) error {
+	js, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE idempotency_keys
+		SET status_code = $1, header = $2, body = $3
+		WHERE user_id = $4 AND key = $5`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, statusCode, js, body, userID, key)
+	return err
+}
+
+// The Release() method deletes a reserved idempotency key without storing a response,
+// so that the request can be retried from scratch.
+func (m IdempotencyModel) Release(userID int64, key string) error {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, key)
+	return err
+}
+
+// The DeleteExpired() method deletes all expired idempotency keys and returns the
+// number of keys deleted.
+func (m IdempotencyModel) DeleteExpired() (int64, error) {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -1,8 +1,11 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+
+	"bookworm.onatim.com/internal/tracing"
 )
 
 // Define custom errors. We'll return these from our Get() and Update() methods.
@@ -11,21 +14,80 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// A querier is satisfied by both *sql.DB and *sql.Tx, so functions which accept one can
+// run their queries either directly on the connection pool or inside a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// The withTx() function runs fn inside a transaction, committing it if fn returns nil
+// and rolling it back otherwise.
+func withTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rolling back after a successful commit is a no-op, so this is safe to defer.
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The startQuerySpan() function starts a client span for a model method, as a child of
+// the request span in ctx. If ctx doesn't hold a span nothing is recorded.
+func startQuerySpan(ctx context.Context, name string) (context.Context, *tracing.Span) {
+	ctx, span := tracing.StartKind(ctx, name, tracing.SpanKindClient)
+	span.SetAttribute("db.system", "postgresql")
+	return ctx, span
+}
+
+// The detachedContext() function returns a copy of the context passed to a model's
+// WithContext() method which isn't cancelled along with it, so that the model keeps
+// the request's trace but still applies its own timeouts. Models which haven't been
+// given a context (like those used by the background workers) have a nil ctx.
+func detachedContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return context.WithoutCancel(ctx)
+}
+
 // Create a Models struct which wraps the BookModel.
 type Models struct {
-	Books       BookModel
-	Permissions PermissionModel
-	Tokens      TokenModel
-	Users       UserModel
+	Books           BookModel
+	Files           BookFileModel
+	Genres          GenreModel
+	Health          HealthModel
+	Idempotency     IdempotencyModel
+	Permissions     PermissionModel
+	Recommendations RecommendationModel
+	Revisions       RevisionModel
+	Series          SeriesModel
+	Tokens          TokenModel
+	Users           UserModel
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing
 // the initialized BookModel.
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Books:       BookModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
+		Books:           BookModel{DB: db},
+		Files:           BookFileModel{DB: db},
+		Genres:          GenreModel{DB: db},
+		Health:          HealthModel{DB: db},
+		Idempotency:     IdempotencyModel{DB: db},
+		Permissions:     PermissionModel{DB: db},
+		Recommendations: RecommendationModel{DB: db},
+		Revisions:       RevisionModel{DB: db},
+		Series:          SeriesModel{DB: db},
+		Tokens:          TokenModel{DB: db},
+		Users:           UserModel{DB: db},
 	}
 }
@@ -0,0 +1,186 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The number of similar books kept for each book, and the number of recommendations
+// kept for each user, when the recommendations are refreshed. The number of candidates
+// scored for each book is capped too, so that a genre shared by most of the catalogue
+// (like "fiction") doesn't mean comparing every book with every other book.
+const (
+	maxSimilarBooks      = 20
+	maxRecommendations   = 50
+	maxSimilarCandidates = 1000
+)
+
+// The key of the advisory lock taken while refreshing the recommendations, so that
+// only one instance of the API refreshes them at a time.
+const recommendationsLockKey = 7_240_040
+
+// A Recommendation is a book along with its score, which is higher for better matches.
+type Recommendation struct {
+	Score float64
+	Book  *Book
+}
+
+// Define the RecommendationModel type. Recommendations are expensive to work out, so
+// they are precomputed by Refresh() and stored in the book_similarities and
+// user_recommendations tables, which the other methods read from.
+type RecommendationModel struct {
+	DB *sql.DB
+}
+
+// The Refresh() method recomputes all the recommendations in a single transaction, so
+// readers see either the old or the new results and never a mix. It returns false
+// without doing anything if another refresh is already running.
+//
+// Two books are similar if they share genres, and are scored by the Jaccard index of
+// their genres (the number of genres they share over the number of genres between
+// them). The overlap operator lets PostgreSQL use the GIN index on the genres column
+// to find the candidates for each book, of which only the newest maxSimilarCandidates
+// are scored.
+//
+// Users don't have libraries, so a user's recommendations are based on the books they
+// have added or edited, which we know from the book revisions. Each book which is
+// similar to one of those (and which the user hasn't touched themselves) is scored by
+// adding up its similarity scores, so books similar to several of them come first.
+//
+// The refresh is rolled back if ctx is cancelled, such as when the server is shutting
+// down, leaving the previous results in place.
+func (m RecommendationModel) Refresh(ctx context.Context) (bool, error) {
+	// Give the refresh a much longer timeout than usual, as it works through every book.
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	refreshed := false
+
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, recommendationsLockKey).Scan(&refreshed)
+		if err != nil || !refreshed {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM book_similarities`)
+		if err != nil {
+			return err
+		}
+
+		query := `
+			INSERT INTO book_similarities (book_id, similar_book_id, score)
+			SELECT books.id, similar.id, similar.score
+			FROM books
+			CROSS JOIN LATERAL (
+				SELECT candidate.id,
+					cardinality(ARRAY(SELECT unnest(books.genres) INTERSECT SELECT unnest(candidate.genres)))::double precision /
+					cardinality(ARRAY(SELECT unnest(books.genres) UNION SELECT unnest(candidate.genres))) AS score
+				FROM (
+					SELECT other.id, other.genres
+					FROM books AS other
+					WHERE other.genres && books.genres AND other.id <> books.id AND other.deleted_at IS NULL
+					ORDER BY other.id DESC
+					LIMIT $2
+				) AS candidate
+				ORDER BY score DESC, candidate.id
+				LIMIT $1
+			) AS similar
+			WHERE books.deleted_at IS NULL`
+
+		_, err = tx.ExecContext(ctx, query, maxSimilarBooks, maxSimilarCandidates)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM user_recommendations`)
+		if err != nil {
+			return err
+		}
+
+		query = `
+			INSERT INTO user_recommendations (user_id, book_id, score)
+			SELECT user_id, book_id, score
+			FROM (
+				SELECT seen.user_id, similar.similar_book_id AS book_id, sum(similar.score) AS score,
+					row_number() OVER (PARTITION BY seen.user_id ORDER BY sum(similar.score) DESC, similar.similar_book_id) AS rank
+				FROM (SELECT DISTINCT user_id, book_id FROM book_revisions WHERE user_id IS NOT NULL) AS seen
+				INNER JOIN book_similarities AS similar ON similar.book_id = seen.book_id
+				WHERE NOT EXISTS (
+					SELECT 1 FROM book_revisions
+					WHERE book_revisions.user_id = seen.user_id AND book_revisions.book_id = similar.similar_book_id
+				)
+				GROUP BY seen.user_id, similar.similar_book_id
+			) AS ranked
+			WHERE rank <= $1`
+
+		_, err = tx.ExecContext(ctx, query, maxRecommendations)
+		return err
+	})
+
+	return refreshed, err
+}
+
+// The GetSimilar() method returns a page of the books which are similar to the given
+// book, best matches first, along with the pagination metadata. Only the columns needed
+// for the fields in the fieldset are selected.
+func (m RecommendationModel) GetSimilar(bookID int64, filters Filters, fieldset Fieldset) ([]*Recommendation, Metadata, error) {
+	return m.getAll(`
+		FROM book_similarities
+		INNER JOIN books ON books.id = book_similarities.similar_book_id
+		WHERE book_similarities.book_id = $1 AND books.deleted_at IS NULL`, bookID, filters, fieldset)
+}
+
+// The GetForUser() method returns a page of the recommendations for a user, best
+// matches first, along with the pagination metadata.
+func (m RecommendationModel) GetForUser(userID int64, filters Filters, fieldset Fieldset) ([]*Recommendation, Metadata, error) {
+	return m.getAll(`
+		FROM user_recommendations
+		INNER JOIN books ON books.id = user_recommendations.book_id
+		WHERE user_recommendations.user_id = $1 AND books.deleted_at IS NULL`, userID, filters, fieldset)
+}
+
+// The getAll() method does the work for GetSimilar() and GetForUser(). The from string
+// holds the FROM and WHERE clauses, which must select from a table with a score column
+// joined to the books table.
+func (m RecommendationModel) getAll(from string, id int64, filters Filters, fieldset Fieldset) ([]*Recommendation, Metadata, error) {
+	columns := fieldset.columns(bookColumns, bookColumnOrder, "id")
+
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), score, %s
+		%s
+		ORDER BY score DESC, books.id
+		LIMIT $2 OFFSET $3`, strings.Join(columns, ", "), from)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, id, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	recommendations := []*Recommendation{}
+
+	for rows.Next() {
+		recommendation := Recommendation{Book: &Book{}}
+
+		err := rows.Scan(append([]any{&totalRecords, &recommendation.Score}, recommendation.Book.scanTargets(columns)...)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		recommendations = append(recommendations, &recommendation)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return recommendations, metadata, nil
+}
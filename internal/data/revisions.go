@@ -0,0 +1,279 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	"bookworm.onatim.com/internal/tracing"
+	"github.com/lib/pq"
+)
+
+// Define the actions which are recorded in the book_revisions table.
+const (
+	RevisionCreate  = "create"
+	RevisionUpdate  = "update"
+	RevisionDelete  = "delete"
+	RevisionRestore = "restore"
+	RevisionPurge   = "purge"
+)
+
+// A Revision records a single change to a book: what was done, by whom, the fields which
+// changed and the version number the book had afterwards. UserID is nil if the change
+// wasn't made by a known user.
+type Revision struct {
+	ID        int64             `json:"id"`
+	BookID    int64             `json:"book_id"`
+	Version   int32             `json:"version"`
+	Action    string            `json:"action"`
+	UserID    *int64            `json:"user_id"`
+	Changes   map[string]Change `json:"changes"`
+	State     BookState         `json:"-"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// A Change holds the old and new values of a single field.
+type Change struct {
+	Old any `json:"old"`
+	New any `json:"new"`
+}
+
+// A BookState is a snapshot of the editable fields of a book, which we store with every
+// revision so that a book can be reverted to it. We store the ISBN as a plain integer,
+// rather than using the ISBN type and its custom JSON format.
+type BookState struct {
+	Title   string   `json:"title"`
+	Year    int32    `json:"year"`
+	ISBN    int32    `json:"isbn"`
+	Genres  []string `json:"genres"`
+	Deleted bool     `json:"deleted"`
+}
+
+// Return the state of the book, or the zero value if book is nil.
+func stateOf(book *Book) BookState {
+	if book == nil {
+		return BookState{}
+	}
+
+	return BookState{
+		Title:   book.Title,
+		Year:    book.Year,
+		ISBN:    int32(book.ISBN),
+		Genres:  book.Genres,
+		Deleted: book.DeletedAt != nil,
+	}
+}
+
+// Apply copies the editable fields in the state to the book.
+func (s BookState) Apply(book *Book) {
+	book.Title = s.Title
+	book.Year = s.Year
+	book.ISBN = ISBN(s.ISBN)
+	book.Genres = s.Genres
+}
+
+// Return the fields which differ between two states.
+func diffStates(before, after BookState) map[string]Change {
+	changes := make(map[string]Change)
+
+	if before.Title != after.Title {
+		changes["title"] = Change{before.Title, after.Title}
+	}
+	if before.Year != after.Year {
+		changes["year"] = Change{before.Year, after.Year}
+	}
+	if before.ISBN != after.ISBN {
+		changes["ISBN"] = Change{before.ISBN, after.ISBN}
+	}
+	if !slices.Equal(before.Genres, after.Genres) {
+		changes["genres"] = Change{before.Genres, after.Genres}
+	}
+	if before.Deleted != after.Deleted {
+		changes["deleted"] = Change{before.Deleted, after.Deleted}
+	}
+
+	return changes
+}
+
+// The recordRevision() function inserts a revision for a change to a book, where before
+// and after are the book before and after the change (before is nil for a newly
+// created book). It should be called in the same transaction as the change itself.
+func recordRevision(ctx context.Context, q querier, action string, before, after *Book, userID int64) error {
+	return insertRevision(ctx, q, action, after, diffStates(stateOf(before), stateOf(after)), userID)
+}
+
+// The insertRevision() function inserts a revision with the given changes, for changes
+// to a book which aren't part of its BookState, such as taking it out of a series.
+func insertRevision(ctx context.Context, q querier, action string, after *Book, changeset map[string]Change, userID int64) error {
+	changes, err := json.Marshal(changeset)
+	if err != nil {
+		return err
+	}
+
+	state, err := json.Marshal(stateOf(after))
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO book_revisions (book_id, version, action, user_id, changes, state)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+
+	// The anonymous user has an ID of 0, which we store as NULL.
+	args := []any{after.ID, after.Version, action, sql.NullInt64{Int64: userID, Valid: userID > 0}, changes, state}
+
+	_, err = q.ExecContext(ctx, query, args...)
+	return err
+}
+
+// The lockBook() function fetches a book which isn't in the trash and locks its row
+// until the end of the transaction, so that we can compare it with the updated version
+// without anyone else changing it in between.
+func lockBook(ctx context.Context, tx *sql.Tx, id int64) (*Book, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, title, year, isbn, genres, version, cover
+		FROM books
+		WHERE id = $1 AND deleted_at IS NULL
+		FOR UPDATE`
+
+	var book Book
+
+	err := tx.QueryRowContext(ctx, query, id).Scan(
+		&book.ID,
+		&book.CreatedAt,
+		&book.Title,
+		&book.Year,
+		&book.ISBN,
+		pq.Array(&book.Genres),
+		&book.Version,
+		&book.Cover,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &book, nil
+}
+
+// Define a RevisionModel type which wraps a sql.DB connection pool. Like BookModel,
+// the ctx field is set by WithContext() to trace queries as part of a request.
+type RevisionModel struct {
+	DB  *sql.DB
+	ctx context.Context
+}
+
+// WithContext() returns a copy of the model whose queries are traced as part of the
+// request in ctx.
+func (m RevisionModel) WithContext(ctx context.Context) RevisionModel {
+	m.ctx = ctx
+	return m
+}
+
+func (m RevisionModel) startSpan(name string) (context.Context, *tracing.Span) {
+	return startQuerySpan(detachedContext(m.ctx), name)
+}
+
+// The GetAllForBook() method returns a page of the revisions for a book, most recent
+// first, along with the pagination metadata.
+func (m RevisionModel) GetAllForBook(bookID int64, filters Filters) ([]*Revision, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), id, book_id, version, action, user_id, changes, state, created_at
+		FROM book_revisions
+		WHERE book_id = $1
+		ORDER BY version DESC, id DESC
+		LIMIT $2 OFFSET $3`
+
+	ctx, span := m.startSpan("RevisionModel.GetAllForBook")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, bookID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	revisions := []*Revision{}
+
+	for rows.Next() {
+		var revision Revision
+
+		err := revision.scan(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		revisions = append(revisions, &revision)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return revisions, metadata, nil
+}
+
+// The GetVersion() method returns the revision which produced the given version of a
+// book.
+func (m RevisionModel) GetVersion(bookID int64, version int32) (*Revision, error) {
+	query := `
+		SELECT id, book_id, version, action, user_id, changes, state, created_at
+		FROM book_revisions
+		WHERE book_id = $1 AND version = $2
+		ORDER BY id DESC
+		LIMIT 1`
+
+	ctx, span := m.startSpan("RevisionModel.GetVersion")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var revision Revision
+
+	err := revision.scan(m.DB.QueryRowContext(ctx, query, bookID, version))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &revision, nil
+}
+
+// Scan a row into the revision, decoding the JSON columns. Any extra destinations (such
+// as a window function count) are scanned before the revision columns.
+func (r *Revision) scan(row interface{ Scan(...any) error }, extra ...any) error {
+	var changes, state []byte
+
+	err := row.Scan(append(extra, &r.ID, &r.BookID, &r.Version, &r.Action, &r.UserID, &changes, &state, &r.CreatedAt)...)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(changes, &r.Changes)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(state, &r.State)
+}
@@ -3,6 +3,7 @@ package data
 import (
 	"errors"
 	"fmt"
+	"path"
 	"strconv"
 	"strings"
 )
@@ -45,20 +46,100 @@ func (r *ISBN) UnmarshalJSON(jsonValue []byte) error {
 		return ErrInvalidISBNFormat
 	}
 
+	// Parse the unquoted string using the ParseISBN() function below.
+	isbn, err := ParseISBN(unquotedJSONValue)
+	if err != nil {
+		return err
+	}
+
+	// Assign the ISBN to the receiver. Note that we use the * operator to deference
+	// the receiver (which is a pointer to a ISBN type) in order to set the underlying
+	// value of the pointer.
+	*r = isbn
+
+	return nil
+}
+
+// The Digits() method returns the ISBN as it's looked up with a metadata provider: ten
+// digits with no hyphens. Any leading zeros, which are lost when the ISBN is stored as
+// an integer, are added back.
+func (r ISBN) Digits() string {
+	return fmt.Sprintf("%010d", int32(r))
+}
+
+// ParseISBN parses a string in the format "978-0-306-40615-7" into an ISBN, returning
+// the ErrInvalidISBNFormat error if it can't be converted.
+func ParseISBN(s string) (ISBN, error) {
 	// Remove hyphens
-	cleanedISBN := strings.ReplaceAll(unquotedJSONValue, "-", "")
+	cleanedISBN := strings.ReplaceAll(s, "-", "")
 
-	// Otherwise, parse the string containing the number into an int32. Again, if this
-	// fails return the ErrInvalidISBNFormat error.
+	// Parse the string containing the number into an int32. If this fails return the
+	// ErrInvalidISBNFormat error.
 	i, err := strconv.ParseInt(cleanedISBN, 10, 32)
 	if err != nil {
-		return ErrInvalidISBNFormat
+		return 0, ErrInvalidISBNFormat
 	}
 
-	// Convert the int32 to a ISBN type and assign this to the receiver. Note that we
-	// use the * operator to deference the receiver (which is a pointer to a ISBN
-	// type) in order to set the underlying value of the pointer.
-	*r = ISBN(i)
+	return ISBN(i), nil
+}
 
-	return nil
+// Declare a custom Cover type, which holds the storage key of a book's cover image,
+// like "covers/12/3fa9c1d2.jpg". An empty string means the book has no cover.
+type Cover string
+
+// The sizes of the thumbnails generated for each cover, as the name of the size and its
+// maximum width in pixels. The thumbnails are stored alongside the original image, with
+// the name of the size added to the key.
+var CoverSizes = []struct {
+	Name  string
+	Width int
+}{
+	{"small", 160},
+	{"medium", 480},
+}
+
+// Cover images are served from the "GET /v1/covers/*path" endpoint, so the URL of a
+// cover is its storage key under the /v1/ prefix.
+const coverURLPrefix = "/v1/"
+
+// The Key() method returns the storage key for the given size of the cover. An empty
+// size returns the key of the original image.
+func (c Cover) Key(size string) string {
+	if size == "" {
+		return string(c)
+	}
+
+	ext := path.Ext(string(c))
+	return strings.TrimSuffix(string(c), ext) + "-" + size + ext
+}
+
+// The Keys() method returns the storage keys for the original image and all its
+// thumbnails.
+func (c Cover) Keys() []string {
+	keys := []string{c.Key("")}
+	for _, size := range CoverSizes {
+		keys = append(keys, c.Key(size.Name))
+	}
+	return keys
+}
+
+// The URL() method returns the URL which the given size of the cover is served from.
+func (c Cover) URL(size string) string {
+	return coverURLPrefix + c.Key(size)
+}
+
+// The URLs() method returns the URLs of the original image and all its thumbnails,
+// keyed by size, with the original under "original".
+func (c Cover) URLs() map[string]string {
+	urls := map[string]string{"original": c.URL("")}
+	for _, size := range CoverSizes {
+		urls[size.Name] = c.URL(size.Name)
+	}
+	return urls
+}
+
+// Implement a MarshalJSON() method on the Cover type so that it is encoded as the URL
+// of the original image, rather than the storage key.
+func (c Cover) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(c.URL(""))), nil
 }
@@ -0,0 +1,374 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"bookworm.onatim.com/internal/tracing"
+	"bookworm.onatim.com/internal/validator"
+	"github.com/lib/pq"
+)
+
+// A Series is an ordered group of books, such as a trilogy. Each book in a series has a
+// position, and BookCount holds the number of books in it (not counting any which are
+// in the trash).
+type Series struct {
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"-"`
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"`
+	BookCount   int       `json:"book_count"`
+	Version     int32     `json:"version"`
+}
+
+func ValidateSeries(v *validator.Validator, series *Series) {
+	v.Check(series.Title != "", "title", "must be provided")
+	v.Check(len(series.Title) <= 500, "title", "must not be more than 500 bytes long")
+
+	v.Check(len(series.Description) <= 5000, "description", "must not be more than 5000 bytes long")
+}
+
+// The ValidateSeriesPosition() function checks the position of a book in a series.
+func ValidateSeriesPosition(v *validator.Validator, position *float64) {
+	v.Check(position != nil, "position", "must be provided")
+	if position != nil {
+		v.Check(*position >= 0, "position", "must not be negative")
+		v.Check(*position <= 10_000, "position", "must not be more than 10000")
+	}
+}
+
+// Define the SeriesModel type. Like BookModel, the ctx field is set by WithContext()
+// to trace queries as part of a request.
+type SeriesModel struct {
+	DB  *sql.DB
+	ctx context.Context
+}
+
+// WithContext() returns a copy of the model whose queries are traced as part of the
+// request in ctx.
+func (m SeriesModel) WithContext(ctx context.Context) SeriesModel {
+	m.ctx = ctx
+	return m
+}
+
+func (m SeriesModel) startSpan(name string) (context.Context, *tracing.Span) {
+	return startQuerySpan(detachedContext(m.ctx), name)
+}
+
+// The Insert() method adds a new series.
+func (m SeriesModel) Insert(series *Series) error {
+	query := `
+		INSERT INTO series (title, description)
+		VALUES ($1, $2)
+		RETURNING id, created_at, version`
+
+	ctx, span := m.startSpan("SeriesModel.Insert")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, series.Title, series.Description).Scan(&series.ID, &series.CreatedAt, &series.Version)
+}
+
+// The seriesQuery format string selects series along with their book counts. The
+// placeholder is for the WHERE clause and anything after it.
+const seriesQuery = `
+	SELECT %s series.id, series.created_at, series.title, series.description,
+		(SELECT count(*) FROM books WHERE books.series_id = series.id AND books.deleted_at IS NULL),
+		series.version
+	FROM series
+	%s`
+
+// Return the Series fields to scan a row from seriesQuery into, with any extra
+// destinations (such as a window function count) first.
+func (s *Series) scanTargets(extra ...any) []any {
+	return append(extra, &s.ID, &s.CreatedAt, &s.Title, &s.Description, &s.BookCount, &s.Version)
+}
+
+// The Get() method returns the series with the given ID.
+func (m SeriesModel) Get(id int64) (*Series, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(seriesQuery, "", "WHERE series.id = $1")
+
+	ctx, span := m.startSpan("SeriesModel.Get")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var series Series
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(series.scanTargets()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &series, nil
+}
+
+// The GetMany() method returns the series with the given IDs, ordered by ID. Any IDs
+// which don't match a series are ignored.
+func (m SeriesModel) GetMany(ids []int64) ([]*Series, error) {
+	all := []*Series{}
+
+	if len(ids) == 0 {
+		return all, nil
+	}
+
+	query := fmt.Sprintf(seriesQuery, "", "WHERE series.id = ANY($1) ORDER BY series.id")
+
+	ctx, span := m.startSpan("SeriesModel.GetMany")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var series Series
+
+		err := rows.Scan(series.scanTargets()...)
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, &series)
+	}
+
+	return all, rows.Err()
+}
+
+// The GetAll() method returns a page of series, optionally filtered by title, along
+// with the pagination metadata.
+func (m SeriesModel) GetAll(title string, filters Filters) ([]*Series, Metadata, error) {
+	query := fmt.Sprintf(seriesQuery, "count(*) OVER(),", fmt.Sprintf(`
+	WHERE (to_tsvector('simple', series.title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+	ORDER BY series.%s %s, series.id ASC
+	LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection()))
+
+	ctx, span := m.startSpan("SeriesModel.GetAll")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, title, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	all := []*Series{}
+
+	for rows.Next() {
+		var series Series
+
+		err := rows.Scan(series.scanTargets(&totalRecords)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		all = append(all, &series)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return all, metadata, nil
+}
+
+// The GetBooks() method returns the books in a series in reading order. Books at the
+// same position are ordered by ID.
+func (m SeriesModel) GetBooks(id int64, fieldset Fieldset) ([]*Book, error) {
+	columns := fieldset.columns(bookColumns, bookColumnOrder, "id", "series_id", "series_position")
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM books
+		WHERE series_id = $1 AND deleted_at IS NULL
+		ORDER BY series_position, id`, strings.Join(columns, ", "))
+
+	ctx, span := m.startSpan("SeriesModel.GetBooks")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []*Book{}
+
+	for rows.Next() {
+		var book Book
+
+		err := rows.Scan(book.scanTargets(columns)...)
+		if err != nil {
+			return nil, err
+		}
+
+		books = append(books, &book)
+	}
+
+	return books, rows.Err()
+}
+
+// The Update() method saves the changes to a series, using its version number for
+// optimistic concurrency control.
+func (m SeriesModel) Update(series *Series) error {
+	query := `
+		UPDATE series
+		SET title = $1, description = $2, version = version + 1
+		WHERE id = $3 AND version = $4
+		RETURNING version`
+
+	ctx, span := m.startSpan("SeriesModel.Update")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, series.Title, series.Description, series.ID, series.Version).Scan(&series.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The Delete() method deletes a series. The books in it aren't deleted, but are taken
+// out of the series, which increments their version numbers. A revision is recorded for
+// each of the books, so that their history accounts for every version.
+func (m SeriesModel) Delete(id int64, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, span := m.startSpan("SeriesModel.Delete")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		query := `
+			UPDATE books
+			SET series_id = NULL, series_position = NULL, updated_at = NOW(), version = version + 1
+			WHERE series_id = $1
+			RETURNING id, title, year, isbn, genres, version, deleted_at`
+
+		rows, err := tx.QueryContext(ctx, query, id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		var books []*Book
+
+		for rows.Next() {
+			var book Book
+
+			err := rows.Scan(&book.ID, &book.Title, &book.Year, &book.ISBN, pq.Array(&book.Genres), &book.Version, &book.DeletedAt)
+			if err != nil {
+				return err
+			}
+
+			books = append(books, &book)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		// The series isn't part of a book's state, so record the change by hand.
+		changes := map[string]Change{"series": {Old: id, New: nil}}
+
+		for _, book := range books {
+			err := insertRevision(ctx, tx, RevisionUpdate, book, changes, userID)
+			if err != nil {
+				return err
+			}
+		}
+
+		result, err := tx.ExecContext(ctx, `DELETE FROM series WHERE id = $1`, id)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+
+		return nil
+	})
+}
+
+// The SetSeries() method puts a book into a series at the given position, or takes it
+// out of its series if seriesID is nil. A book can only be in one series, so this moves
+// it from any series it was already in. Like SetCover(), this uses and increments the
+// version number of the book, but isn't recorded in the book's revision history. If the
+// series has been deleted in the meantime, ErrRecordNotFound is returned.
+func (m BookModel) SetSeries(book *Book, seriesID *int64, position *float64) error {
+	query := `
+		UPDATE books
+		SET series_id = $1, series_position = $2, updated_at = NOW(), version = version + 1
+		WHERE id = $3 AND version = $4 AND deleted_at IS NULL
+		RETURNING updated_at, version`
+
+	ctx, span := m.startSpan("BookModel.SetSeries")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, seriesID, position, book.ID, book.Version).Scan(&book.UpdatedAt, &book.Version)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case errors.As(err, &pqErr) && pqErr.Code == "23503":
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	book.SeriesID = seriesID
+	book.SeriesPosition = position
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The GetTrash() method returns a page of the books which have been moved to the trash,
+// along with the pagination metadata.
+func (m BookModel) GetTrash(filters Filters) ([]*Book, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, updated_at, title, year, isbn, genres, version, cover, series_id, series_position, deleted_at
+		FROM books
+		WHERE deleted_at IS NOT NULL
+		ORDER BY %s %s, id ASC
+		LIMIT $1 OFFSET $2`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, span := m.startSpan("BookModel.GetTrash")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	books := []*Book{}
+
+	for rows.Next() {
+		var book Book
+
+		err := rows.Scan(
+			&totalRecords,
+			&book.ID,
+			&book.CreatedAt,
+			&book.UpdatedAt,
+			&book.Title,
+			&book.Year,
+			&book.ISBN,
+			pq.Array(&book.Genres),
+			&book.Version,
+			&book.Cover,
+			&book.SeriesID,
+			&book.SeriesPosition,
+			&book.DeletedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		books = append(books, &book)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return books, metadata, nil
+}
+
+// The Restore() method moves a book out of the trash on behalf of the given user, and
+// returns the restored book. If there is no book with the given ID in the trash,
+// ErrRecordNotFound is returned. Like Delete(), this increments the version number and
+// records a revision.
+func (m BookModel) Restore(id, userID int64) (*Book, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		UPDATE books
+		SET deleted_at = NULL, updated_at = NOW(), version = version + 1
+		WHERE id = $1 AND deleted_at IS NOT NULL
+		RETURNING id, created_at, updated_at, title, year, isbn, genres, version, cover, series_id, series_position`
+
+	ctx, span := m.startSpan("BookModel.Restore")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var book Book
+
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, id).Scan(
+			&book.ID,
+			&book.CreatedAt,
+			&book.UpdatedAt,
+			&book.Title,
+			&book.Year,
+			&book.ISBN,
+			pq.Array(&book.Genres),
+			&book.Version,
+			&book.Cover,
+			&book.SeriesID,
+			&book.SeriesPosition,
+		)
+		if err != nil {
+			return err
+		}
+
+		// The book was the same before it was restored, apart from being in the trash.
+		before := book
+		before.DeletedAt = &time.Time{}
+
+		return recordRevision(ctx, tx, RevisionRestore, &before, &book, userID)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &book, nil
+}
+
+// The Purge() method permanently deletes all books which were moved to the trash
+// before the given time. It returns the number of books deleted, along with the
+// storage keys of their cover images and ebook files so that the caller can delete
+// them too. A purge revision is recorded for each book, and its earlier revisions are
+// kept, so the audit history survives the book itself.
+func (m BookModel) Purge(before time.Time) (int64, []string, error) {
+	// The book_files rows are removed by the foreign key cascade, but the subquery in
+	// the RETURNING clause still sees them, as it runs against the snapshot taken at
+	// the start of the statement.
+	query := `
+		DELETE FROM books
+		WHERE deleted_at < $1
+		RETURNING id, created_at, title, year, isbn, genres, version, deleted_at, cover,
+			ARRAY(SELECT key FROM book_files WHERE book_files.book_id = books.id)`
+
+	ctx, span := m.startSpan("BookModel.Purge")
+	defer span.End()
+
+	// Give the purge a little longer than usual, as it may delete a lot of rows.
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var purged []*Book
+	keys := []string{}
+
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, query, before)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var book Book
+			var files []string
+
+			err := rows.Scan(
+				&book.ID,
+				&book.CreatedAt,
+				&book.Title,
+				&book.Year,
+				&book.ISBN,
+				pq.Array(&book.Genres),
+				&book.Version,
+				&book.DeletedAt,
+				&book.Cover,
+				pq.Array(&files),
+			)
+			if err != nil {
+				return err
+			}
+
+			if book.Cover != "" {
+				keys = append(keys, book.Cover.Keys()...)
+			}
+			keys = append(keys, files...)
+
+			purged = append(purged, &book)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		// The rows have to be closed before running any more statements in the
+		// transaction. Purging doesn't change any fields, so each revision records
+		// the book's final state with no changes.
+		rows.Close()
+
+		for _, book := range purged {
+			after := *book
+			after.Version++
+
+			err := recordRevision(ctx, tx, RevisionPurge, book, &after, 0)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return int64(len(purged)), keys, nil
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"time"
 
+	"bookworm.onatim.com/internal/tracing"
 	"bookworm.onatim.com/internal/validator"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -112,9 +113,22 @@ func ValidateUser(v *validator.Validator, user *User) {
 	}
 }
 
-// Create a UserModel struct which wraps the connection pool.
+// Create a UserModel struct which wraps the connection pool. Like BookModel, the ctx
+// field is set by WithContext() to trace queries as part of a request.
 type UserModel struct {
-	DB *sql.DB
+	DB  *sql.DB
+	ctx context.Context
+}
+
+// WithContext() returns a copy of the model whose queries are traced as part of the
+// request in ctx.
+func (m UserModel) WithContext(ctx context.Context) UserModel {
+	m.ctx = ctx
+	return m
+}
+
+func (m UserModel) startSpan(name string) (context.Context, *tracing.Span) {
+	return startQuerySpan(detachedContext(m.ctx), name)
 }
 
 // Insert a new record in the database for the user. Note that the id, created_at and
@@ -129,7 +143,10 @@ func (m UserModel) Insert(user *User) error {
 
 	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, span := m.startSpan("UserModel.Insert")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// If the table already contains a record with this email address, then when we try
@@ -159,7 +176,10 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, span := m.startSpan("UserModel.GetByEmail")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -205,7 +225,10 @@ func (m UserModel) Update(user *User) error {
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, span := m.startSpan("UserModel.Update")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
@@ -246,7 +269,10 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, span := m.startSpan("UserModel.GetForToken")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// Execute the query, scanning the return values into a User struct. If no matching
@@ -1,89 +1,235 @@
 package jsonlog
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Define a Level type to represent the severity level for a log entry.
 type Level int8
 
-// Initialize constants which represent a specific severity level. We use the iota
-// keyword as a shortcut to assign successive integer values to the constants.
+// Initialize constants which represent a specific severity level. The values match
+// those of the log/slog package, which makes translating between the two simple, and
+// leave gaps between the levels in the same way.
 const (
-	LevelInfo  Level = iota // Has the value 0.
-	LevelError              // Has the value 1.
-	LevelFatal              // Has the value 2.
-	LevelOff                // Has the value 3.
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+	LevelFatal Level = 12
+	LevelOff   Level = 16
 )
 
 // Return a human-friendly string for the severity level.
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarn:
+		return "WARN"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
+// ParseLevel returns the level with the given name, which is case-insensitive, such as
+// "debug" or "WARN".
+func ParseLevel(s string) (Level, error) {
+	for _, level := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError, LevelFatal, LevelOff} {
+		if strings.EqualFold(s, level.String()) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// MarshalText and UnmarshalText let levels be read from and written as JSON strings.
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(strings.ToLower(l.String())), nil
+}
+
+func (l *Level) UnmarshalText(text []byte) error {
+	level, err := ParseLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
+// An Attr is a typed key/value pair which appears in the properties of a log entry.
+// Use the constructor functions below, like String() and Int(), to create them.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+func String(key, value string) Attr { return Attr{key, value} }
+
+func Int(key string, value int) Attr { return Attr{key, int64(value)} }
+
+func Int64(key string, value int64) Attr { return Attr{key, value} }
+
+func Float64(key string, value float64) Attr { return Attr{key, value} }
+
+func Bool(key string, value bool) Attr { return Attr{key, value} }
+
+func Time(key string, value time.Time) Attr { return Attr{key, value.UTC().Format(time.RFC3339Nano)} }
+
+// Durations are written as a human-friendly string, like "1.5s".
+func Duration(key string, value time.Duration) Attr { return Attr{key, value.String()} }
+
+// Err records an error under the "error" key.
+func Err(err error) Attr { return Attr{"error", err.Error()} }
+
+// Any records any value which can be marshalled to JSON.
+func Any(key string, value any) Attr { return Attr{key, value} }
+
 // Define a custom Logger type. This holds the output destination that the log entries
 // will be written to, the minimum severity level that log entries will be written for,
-// plus a mutex for coordinating the writes.
+// plus a mutex for coordinating the writes. Loggers created with With() share all of
+// these with their parent, so changing the level of one changes it for them all, and
+// also hold attributes which are added to every entry that they write.
 type Logger struct {
+	core  *core
+	attrs []Attr
+}
+
+type core struct {
 	out      io.Writer
-	minLevel Level
+	minLevel atomic.Int32
 	mu       sync.Mutex
 }
 
 // Return a new Logger instance which writes log entries at or above a minimum severity
 // level to a specific output destination.
 func New(out io.Writer, minLevel Level) *Logger {
+	c := &core{out: out}
+	c.minLevel.Store(int32(minLevel))
+
+	return &Logger{core: c}
+}
+
+// SetLevel changes the minimum severity level of the logger, and every logger which
+// shares its output. It's safe to call while other goroutines are logging.
+func (l *Logger) SetLevel(level Level) {
+	l.core.minLevel.Store(int32(level))
+}
+
+// Level returns the current minimum severity level of the logger.
+func (l *Logger) Level() Level {
+	return Level(l.core.minLevel.Load())
+}
+
+// Enabled reports whether entries at the given level would be written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+// With returns a new Logger which adds the given attributes to every entry it writes,
+// such as the ID of the request that it's logging for.
+func (l *Logger) With(attrs ...Attr) *Logger {
+	if len(attrs) == 0 {
+		return l
+	}
+
 	return &Logger{
-		out:      out,
-		minLevel: minLevel,
+		core:  l.core,
+		attrs: append(append([]Attr(nil), l.attrs...), attrs...),
 	}
 }
 
-// Declare some helper methods for writing log entries at the different levels. Notice
-// that these all accept a map as the second parameter which can contain any arbitrary
-// 'properties' that you want to appear in the log entry.
+// Declare some helper methods for writing log entries at the different levels, which
+// accept any number of typed attributes.
+func (l *Logger) Debug(message string, attrs ...Attr) {
+	l.print(LevelDebug, message, attrs)
+}
+
+func (l *Logger) Info(message string, attrs ...Attr) {
+	l.print(LevelInfo, message, attrs)
+}
+
+func (l *Logger) Warn(message string, attrs ...Attr) {
+	l.print(LevelWarn, message, attrs)
+}
+
+func (l *Logger) Error(err error, attrs ...Attr) {
+	l.print(LevelError, err.Error(), attrs)
+}
+
+func (l *Logger) Fatal(err error, attrs ...Attr) {
+	l.print(LevelFatal, err.Error(), attrs)
+	os.Exit(1) // For entries at the FATAL level, we also terminate the application.
+}
+
+// The PrintInfo(), PrintError() and PrintFatal() methods are the original interface
+// to the logger, which accept a map as the second parameter which can contain any
+// arbitrary string 'properties' that you want to appear in the log entry.
 func (l *Logger) PrintInfo(message string, properties map[string]string) {
-	l.print(LevelInfo, message, properties)
+	l.print(LevelInfo, message, stringAttrs(properties))
 }
 
 func (l *Logger) PrintError(err error, properties map[string]string) {
-	l.print(LevelError, err.Error(), properties)
+	l.print(LevelError, err.Error(), stringAttrs(properties))
 }
 
 func (l *Logger) PrintFatal(err error, properties map[string]string) {
-	l.print(LevelFatal, err.Error(), properties)
-	os.Exit(1) // For entries at the FATAL level, we also terminate the application.
+	l.print(LevelFatal, err.Error(), stringAttrs(properties))
+	os.Exit(1)
+}
+
+func stringAttrs(properties map[string]string) []Attr {
+	attrs := make([]Attr, 0, len(properties))
+	for key, value := range properties {
+		attrs = append(attrs, String(key, value))
+	}
+	return attrs
 }
 
 // Print is an internal method for writing the log entry.
-func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
+func (l *Logger) print(level Level, message string, attrs []Attr) (int, error) {
 	// If the severity level of the log entry is below the minimum severity for the
 	// logger, then return with no further action.
-	if level < l.minLevel {
+	if !l.Enabled(level) {
 		return 0, nil
 	}
 
+	// Collect the logger's own attributes and those for this entry into the properties
+	// map. Later attributes win if there are duplicate keys.
+	var properties map[string]any
+	if len(l.attrs)+len(attrs) > 0 {
+		properties = make(map[string]any, len(l.attrs)+len(attrs))
+		for _, attr := range l.attrs {
+			properties[attr.Key] = attr.Value
+		}
+		for _, attr := range attrs {
+			properties[attr.Key] = attr.Value
+		}
+	}
+
 	// Declare an anonymous struct holding the data for the log entry.
 	aux := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
+		Level      string         `json:"level"`
+		Time       string         `json:"time"`
+		Message    string         `json:"message"`
+		Properties map[string]any `json:"properties,omitempty"`
+		Trace      string         `json:"trace,omitempty"`
 	}{
 		Level:      level.String(),
 		Time:       time.Now().UTC().Format(time.RFC3339),
@@ -110,11 +256,11 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 	// Lock the mutex so that no two writes to the output destination can happen
 	// concurrently. If we don't do this, it's possible that the text for two or more
 	// log entries will be intermingled in the output.
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
 
 	// Write the log entry followed by a newline.
-	return l.out.Write(append(line, '\n'))
+	return l.core.out.Write(append(line, '\n'))
 }
 
 // We also implement a Write() method on our Logger type so that it satisfies the
@@ -123,3 +269,17 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 func (l *Logger) Write(message []byte) (n int, err error) {
 	return l.print(LevelError, string(message), nil)
 }
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx which carries the logger, usually one created with
+// With() that holds the fields for a request.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or nil if there isn't one.
+func FromContext(ctx context.Context) *Logger {
+	l, _ := ctx.Value(contextKey{}).(*Logger)
+	return l
+}
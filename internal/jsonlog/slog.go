@@ -0,0 +1,136 @@
+package jsonlog
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Handler adapts a Logger to the slog.Handler interface, so that code can log through
+// log/slog and still have its entries written in our format, at our level. Records
+// logged with a context carrying a logger (see NewContext()) pick up that logger's
+// attributes, like the request ID.
+type Handler struct {
+	logger *Logger
+	attrs  []Attr
+	group  string
+}
+
+// NewHandler returns a new slog.Handler which writes to the given logger. Use it with
+// slog.New(), or slog.SetDefault() to make it the default for the whole program.
+func NewHandler(l *Logger) *Handler {
+	return &Handler{logger: l}
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.logger.Enabled(fromSlogLevel(level))
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	logger := h.logger
+	if l := FromContext(ctx); l != nil {
+		logger = l
+	}
+
+	attrs := make([]Attr, 0, len(h.attrs)+r.NumAttrs())
+	attrs = append(attrs, h.attrs...)
+
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = appendSlogAttr(attrs, h.group, a)
+		return true
+	})
+
+	_, err := logger.print(fromSlogLevel(r.Level), r.Message, attrs)
+	return err
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		h2.attrs = appendSlogAttr(h2.attrs, h.group, a)
+	}
+	return &h2
+}
+
+// Our entries are flat, so groups are written as prefixes on the keys of the
+// attributes in them, like "db.query".
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	h2 := *h
+	h2.group = joinGroup(h.group, name)
+	return &h2
+}
+
+func appendSlogAttr(attrs []Attr, group string, a slog.Attr) []Attr {
+	v := a.Value.Resolve()
+
+	// Attributes with empty keys are ignored, except for groups, whose attributes are
+	// then inlined.
+	if v.Kind() == slog.KindGroup {
+		prefix := group
+		if a.Key != "" {
+			prefix = joinGroup(group, a.Key)
+		}
+		for _, ga := range v.Group() {
+			attrs = appendSlogAttr(attrs, prefix, ga)
+		}
+		return attrs
+	}
+
+	if a.Key == "" {
+		return attrs
+	}
+
+	key := joinGroup(group, a.Key)
+
+	switch v.Kind() {
+	case slog.KindString:
+		return append(attrs, String(key, v.String()))
+	case slog.KindInt64:
+		return append(attrs, Int64(key, v.Int64()))
+	case slog.KindUint64:
+		return append(attrs, Any(key, v.Uint64()))
+	case slog.KindFloat64:
+		return append(attrs, Float64(key, v.Float64()))
+	case slog.KindBool:
+		return append(attrs, Bool(key, v.Bool()))
+	case slog.KindDuration:
+		return append(attrs, Duration(key, v.Duration()))
+	case slog.KindTime:
+		return append(attrs, Time(key, v.Time()))
+	default:
+		// Errors don't marshal to anything useful, so use their message instead.
+		if err, ok := v.Any().(error); ok {
+			return append(attrs, String(key, err.Error()))
+		}
+		return append(attrs, Any(key, v.Any()))
+	}
+}
+
+func joinGroup(group, key string) string {
+	if group == "" {
+		return key
+	}
+	return group + "." + key
+}
+
+// Our levels have the same values as slog's, but slog allows any value in between, so
+// round down to the nearest of ours.
+func fromSlogLevel(level slog.Level) Level {
+	switch {
+	case level < slog.LevelInfo:
+		return LevelDebug
+	case level < slog.LevelWarn:
+		return LevelInfo
+	case level < slog.LevelError:
+		return LevelWarn
+	default:
+		return LevelError
+	}
+}
+
+// Check that Handler satisfies the slog.Handler interface.
+var _ slog.Handler = (*Handler)(nil)
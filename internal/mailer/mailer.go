@@ -2,10 +2,12 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"html/template"
 	"time"
 
+	"bookworm.onatim.com/internal/tracing"
 	"github.com/go-mail/mail/v2"
 )
 
@@ -39,10 +41,26 @@ func New(host string, port int, username, password, sender string) Mailer {
 	}
 }
 
-// Define a Send() method on the Mailer type. This takes the recipient email address
-// as the first parameter, the name of the file containing the templates, and any
-// dynamic data for the templates as an any parameter.
-func (m Mailer) Send(recipient, templateFile string, data any) error {
+// The Ping() method checks that the SMTP server can be reached and that it accepts our
+// credentials, by connecting and authenticating without sending anything. It uses the
+// dialer's 5-second timeout.
+func (m Mailer) Ping() error {
+	conn, err := m.dialer.Dial()
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Define a Send() method on the Mailer type. This takes a context holding the trace
+// that the email belongs to, the recipient email address, the name of the file
+// containing the templates, and any dynamic data for the templates as an any parameter.
+func (m Mailer) Send(ctx context.Context, recipient, templateFile string, data any) error {
+	_, span := tracing.StartKind(ctx, "Mailer.Send", tracing.SpanKindClient)
+	defer span.End()
+
+	span.SetAttribute("mail.template", templateFile)
+
 	// Use the ParseFS() method to parse the required template file from the embedded
 	// file system.
 	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
@@ -97,5 +115,7 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 		time.Sleep(500 * time.Millisecond)
 	}
 
+	span.SetError(err)
+
 	return nil
 }
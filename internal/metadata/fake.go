@@ -0,0 +1,74 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Fake is an in-memory Provider, for use in tests and local development. It returns
+// the records and cover images it has been given, and ErrNotFound for anything else.
+type Fake struct {
+	mu      sync.Mutex
+	records map[string]*Record
+	covers  map[string][]byte
+}
+
+// The NewFake() function returns a Fake provider containing the given records, keyed by
+// ISBN. The map may be nil.
+func NewFake(records map[string]*Record) *Fake {
+	f := &Fake{records: make(map[string]*Record), covers: make(map[string][]byte)}
+	for isbn, record := range records {
+		f.records[isbn] = record
+	}
+	return f
+}
+
+// The Add() method adds a record to the fake, replacing any existing record for the
+// same ISBN.
+func (f *Fake) Add(isbn string, record *Record) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.records[isbn] = record
+}
+
+func (f *Fake) Lookup(ctx context.Context, isbn string) (*Record, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	record, ok := f.records[isbn]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	// Return a copy, so that callers can't change the stored record.
+	r := *record
+	return &r, nil
+}
+
+// The AddCover() method adds a cover image to the fake, which is returned by Cover() for
+// the given URL.
+func (f *Fake) AddCover(coverURL string, image []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.covers[coverURL] = image
+}
+
+func (f *Fake) Cover(ctx context.Context, coverURL string, maxBytes int64) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	image, ok := f.covers[coverURL]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if int64(len(image)) > maxBytes {
+		return nil, fmt.Errorf("metadata: cover is larger than %d bytes", maxBytes)
+	}
+
+	return bytes.Clone(image), nil
+}
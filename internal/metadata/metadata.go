@@ -0,0 +1,45 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// ErrNotFound is returned by a Provider when it has no record for an ISBN.
+var ErrNotFound = errors.New("metadata: no record found")
+
+// A Record holds the bibliographic details that a Provider knows about a book. Any of
+// the fields may be empty if the provider doesn't have them.
+type Record struct {
+	Title    string   `json:"title,omitempty"`
+	Authors  []string `json:"authors,omitempty"`
+	Year     int32    `json:"year,omitempty"`
+	Subjects []string `json:"subjects,omitempty"`
+	CoverURL string   `json:"cover_url,omitempty"`
+}
+
+// The Provider interface is implemented by external catalogues which we can look books
+// up in by ISBN. The isbn argument contains only digits (and possibly a trailing X for
+// ISBN-10s), without any hyphens. Cover() downloads the image at a record's CoverURL,
+// failing if it's larger than maxBytes.
+type Provider interface {
+	Lookup(ctx context.Context, isbn string) (*Record, error)
+	Cover(ctx context.Context, coverURL string, maxBytes int64) ([]byte, error)
+}
+
+// CleanISBN removes the hyphens and spaces from an ISBN, and upper-cases any trailing X,
+// giving the form that a Provider expects. It reports false if the result isn't shaped
+// like an ISBN-10 (nine digits then a digit or X) or an ISBN-13 (thirteen digits).
+// Check digits aren't verified; an ISBN which doesn't exist just won't be found.
+func CleanISBN(s string) (string, bool) {
+	isbn := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(s))
+
+	for i, c := range isbn {
+		if (c < '0' || c > '9') && !(c == 'X' && i == 9 && len(isbn) == 10) {
+			return "", false
+		}
+	}
+
+	return isbn, len(isbn) == 10 || len(isbn) == 13
+}
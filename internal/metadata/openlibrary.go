@@ -0,0 +1,152 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenLibrary looks books up using the Open Library Books API, or any other service
+// which implements the same "/api/books" endpoint.
+type OpenLibrary struct {
+	baseURL string
+	client  *http.Client
+}
+
+// The NewOpenLibrary() function returns an OpenLibrary provider which sends requests to
+// the given base URL (such as "https://openlibrary.org"), giving up on each request
+// after the timeout.
+func NewOpenLibrary(baseURL string, timeout time.Duration) *OpenLibrary {
+	return &OpenLibrary{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// The openLibraryBook struct holds the parts of the API response which we use.
+type openLibraryBook struct {
+	Title       string `json:"title"`
+	PublishDate string `json:"publish_date"`
+	Authors     []struct {
+		Name string `json:"name"`
+	} `json:"authors"`
+	Subjects []struct {
+		Name string `json:"name"`
+	} `json:"subjects"`
+	Cover struct {
+		Large  string `json:"large"`
+		Medium string `json:"medium"`
+	} `json:"cover"`
+}
+
+// Publication dates come in all sorts of formats, like "1995", "June 1995" and
+// "1995-06-01", so we just look for the first four digit number in them.
+var yearRX = regexp.MustCompile(`\b\d{4}\b`)
+
+func (o *OpenLibrary) Lookup(ctx context.Context, isbn string) (*Record, error) {
+	bibkey := "ISBN:" + isbn
+
+	qs := url.Values{}
+	qs.Set("bibkeys", bibkey)
+	qs.Set("format", "json")
+	qs.Set("jscmd", "data")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.baseURL+"/api/books?"+qs.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata: unexpected status from %s: %s", o.baseURL, res.Status)
+	}
+
+	// The response is an object keyed by bibkey, which is empty if the ISBN wasn't
+	// found.
+	var books map[string]openLibraryBook
+
+	err = json.NewDecoder(res.Body).Decode(&books)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: invalid response from %s: %w", o.baseURL, err)
+	}
+
+	book, ok := books[bibkey]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	record := &Record{
+		Title:    book.Title,
+		CoverURL: book.Cover.Large,
+	}
+
+	if record.CoverURL == "" {
+		record.CoverURL = book.Cover.Medium
+	}
+
+	if year, err := strconv.ParseInt(yearRX.FindString(book.PublishDate), 10, 32); err == nil {
+		record.Year = int32(year)
+	}
+
+	for _, author := range book.Authors {
+		record.Authors = append(record.Authors, author.Name)
+	}
+
+	for _, subject := range book.Subjects {
+		record.Subjects = append(record.Subjects, subject.Name)
+	}
+
+	return record, nil
+}
+
+// The Cover() method downloads a cover image. Open Library serves its covers from a
+// different host to the API, so the URL from the record is used as it is.
+func (o *OpenLibrary) Cover(ctx context.Context, coverURL string, maxBytes int64) ([]byte, error) {
+	u, err := url.Parse(coverURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("metadata: invalid cover URL %q", coverURL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return nil, ErrNotFound
+	case res.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("metadata: unexpected status from %s: %s", u.Host, res.Status)
+	}
+
+	// Read one byte more than the limit, so that we can tell if the image was too big.
+	image, err := io.ReadAll(io.LimitReader(res.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(image)) > maxBytes {
+		return nil, fmt.Errorf("metadata: cover from %s is larger than %d bytes", u.Host, maxBytes)
+	}
+
+	return image, nil
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"database/sql"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// RegisterDBStats registers gauges and counters for the statistics of a database
+// connection pool, which are read from stats each time the metrics are collected.
+func (reg *Registry) RegisterDBStats(namespace string, stats func() sql.DBStats) {
+	gauge := func(name, help string, value func(s sql.DBStats) float64) {
+		reg.NewGaugeFunc(namespace+"_"+name, help, func() []Sample { return Value(value(stats())) })
+	}
+	counter := func(name, help string, value func(s sql.DBStats) float64) {
+		reg.NewCounterFunc(namespace+"_"+name, help, func() []Sample { return Value(value(stats())) })
+	}
+
+	gauge("max_open_connections", "Maximum number of open connections to the database.",
+		func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) })
+	gauge("open_connections", "Number of established connections, both in use and idle.",
+		func(s sql.DBStats) float64 { return float64(s.OpenConnections) })
+	gauge("in_use_connections", "Number of connections currently in use.",
+		func(s sql.DBStats) float64 { return float64(s.InUse) })
+	gauge("idle_connections", "Number of idle connections.",
+		func(s sql.DBStats) float64 { return float64(s.Idle) })
+	counter("wait_count_total", "Total number of connections waited for.",
+		func(s sql.DBStats) float64 { return float64(s.WaitCount) })
+	counter("wait_duration_seconds_total", "Total time spent waiting for a new connection.",
+		func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() })
+	counter("max_idle_closed_total", "Total number of connections closed due to the maximum number of idle connections.",
+		func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) })
+	counter("max_idle_time_closed_total", "Total number of connections closed due to the maximum idle time.",
+		func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) })
+	counter("max_lifetime_closed_total", "Total number of connections closed due to the maximum lifetime.",
+		func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) })
+}
+
+// RegisterRuntimeStats registers the usual go_* gauges and counters describing the Go
+// runtime: goroutines, threads, memory and garbage collection.
+func (reg *Registry) RegisterRuntimeStats() {
+	// runtime.ReadMemStats() stops the world, so read it at most once per scrape rather
+	// than once for each metric. The metrics are collected in order, and the goroutine
+	// count comes first, so that's when the stats are refreshed.
+	var (
+		mu       sync.Mutex
+		memStats runtime.MemStats
+	)
+
+	mem := func(value func(m *runtime.MemStats) float64) func() []Sample {
+		return func() []Sample {
+			mu.Lock()
+			defer mu.Unlock()
+			return Value(value(&memStats))
+		}
+	}
+
+	reg.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() []Sample {
+		mu.Lock()
+		runtime.ReadMemStats(&memStats)
+		mu.Unlock()
+
+		return Value(float64(runtime.NumGoroutine()))
+	})
+
+	reg.NewGaugeFunc("go_threads", "Number of OS threads created.", func() []Sample {
+		n, _ := runtime.ThreadCreateProfile(nil)
+		return Value(float64(n))
+	})
+
+	reg.NewGaugeFunc("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.",
+		mem(func(m *runtime.MemStats) float64 { return float64(m.Alloc) }))
+	reg.NewCounterFunc("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.",
+		mem(func(m *runtime.MemStats) float64 { return float64(m.TotalAlloc) }))
+	reg.NewGaugeFunc("go_memstats_sys_bytes", "Number of bytes obtained from the system.",
+		mem(func(m *runtime.MemStats) float64 { return float64(m.Sys) }))
+	reg.NewGaugeFunc("go_memstats_heap_alloc_bytes", "Number of heap bytes allocated and still in use.",
+		mem(func(m *runtime.MemStats) float64 { return float64(m.HeapAlloc) }))
+	reg.NewGaugeFunc("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.",
+		mem(func(m *runtime.MemStats) float64 { return float64(m.HeapInuse) }))
+	reg.NewGaugeFunc("go_memstats_heap_objects", "Number of allocated objects.",
+		mem(func(m *runtime.MemStats) float64 { return float64(m.HeapObjects) }))
+	reg.NewCounterFunc("go_memstats_mallocs_total", "Total number of mallocs.",
+		mem(func(m *runtime.MemStats) float64 { return float64(m.Mallocs) }))
+	reg.NewCounterFunc("go_memstats_frees_total", "Total number of frees.",
+		mem(func(m *runtime.MemStats) float64 { return float64(m.Frees) }))
+	reg.NewGaugeFunc("go_memstats_next_gc_bytes", "Number of heap bytes when the next garbage collection will take place.",
+		mem(func(m *runtime.MemStats) float64 { return float64(m.NextGC) }))
+	reg.NewCounterFunc("go_gc_cycles_total", "Total number of completed garbage collection cycles.",
+		mem(func(m *runtime.MemStats) float64 { return float64(m.NumGC) }))
+	reg.NewCounterFunc("go_gc_pause_seconds_total", "Total time spent in garbage collection pauses.",
+		mem(func(m *runtime.MemStats) float64 { return time.Duration(m.PauseTotalNs).Seconds() }))
+}
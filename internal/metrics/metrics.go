@@ -0,0 +1,293 @@
+// Package metrics implements the small part of Prometheus that we need: counters,
+// histograms and gauges, optionally with labels, which are exposed in the Prometheus
+// text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of the histogram buckets used for request
+// durations, in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// A collector writes the samples for one or more metrics, including their HELP and TYPE
+// lines.
+type collector interface {
+	collect(w *bufio.Writer)
+}
+
+// A Registry holds a set of metrics, and serves them over HTTP in the Prometheus text
+// exposition format.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry returns a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (reg *Registry) register(c collector) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.collectors = append(reg.collectors, c)
+}
+
+// ServeHTTP writes all the metrics in the registry to the response.
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	collectors := slices.Clone(reg.collectors)
+	reg.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.collect(bw)
+	}
+	bw.Flush()
+}
+
+// A Counter is a value which only goes up, such as the number of requests served. It
+// has a separate value for each combination of label values.
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter creates and registers a new Counter with the given label names.
+func (reg *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	reg.register(c)
+	return c
+}
+
+// Add adds v to the counter for the given label values, which must be in the same order
+// as the label names.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := joinLabelValues(c.labels, labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[key] += v
+}
+
+func (c *Counter) collect(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+
+	for _, key := range sortedKeys(c.values) {
+		writeSample(w, c.name, formatLabels(c.labels, key, "", ""), c.values[key])
+	}
+}
+
+// A Histogram counts observations, such as request durations, in configurable buckets,
+// and also keeps their count and sum. It has a separate set of buckets for each
+// combination of label values.
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates and registers a new Histogram with the given bucket upper
+// bounds, which must be in increasing order, and label names.
+func (reg *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+	reg.register(h)
+	return h
+}
+
+// Observe records an observation for the given label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := joinLabelValues(h.labels, labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	// Buckets are cumulative, so the observation counts towards every bucket with an
+	// upper bound at or above it.
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) collect(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+
+		for i, bound := range h.buckets {
+			writeSample(w, h.name+"_bucket", formatLabels(h.labels, key, "le", formatFloat(bound)), float64(s.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", formatLabels(h.labels, key, "le", "+Inf"), float64(s.count))
+		writeSample(w, h.name+"_sum", formatLabels(h.labels, key, "", ""), s.sum)
+		writeSample(w, h.name+"_count", formatLabels(h.labels, key, "", ""), float64(s.count))
+	}
+}
+
+// A Sample is a single value returned by a function passed to NewGaugeFunc() or
+// NewCounterFunc(). LabelValues must line up with the metric's label names.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// A funcMetric is a gauge or counter whose samples are read from a function each time
+// the metrics are collected.
+type funcMetric struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	fn     func() []Sample
+}
+
+// NewGaugeFunc registers a gauge, a value which can go up and down, whose samples are
+// returned by fn each time the metrics are collected.
+func (reg *Registry) NewGaugeFunc(name, help string, fn func() []Sample, labels ...string) {
+	reg.register(&funcMetric{name: name, help: help, kind: "gauge", labels: labels, fn: fn})
+}
+
+// NewCounterFunc registers a counter whose samples are returned by fn each time the
+// metrics are collected. It's useful for exposing counters kept elsewhere, such as the
+// statistics of the database connection pool.
+func (reg *Registry) NewCounterFunc(name, help string, fn func() []Sample, labels ...string) {
+	reg.register(&funcMetric{name: name, help: help, kind: "counter", labels: labels, fn: fn})
+}
+
+func (m *funcMetric) collect(w *bufio.Writer) {
+	writeHeader(w, m.name, m.help, m.kind)
+
+	for _, sample := range m.fn() {
+		key := joinLabelValues(m.labels, sample.LabelValues)
+		writeSample(w, m.name, formatLabels(m.labels, key, "", ""), sample.Value)
+	}
+}
+
+// Value is a convenience function for gauge and counter functions which return a single
+// sample with no labels.
+func Value(v float64) []Sample {
+	return []Sample{{Value: v}}
+}
+
+// Label values are joined with a byte which can't appear in valid UTF-8 to make the
+// keys of the maps which hold each series.
+const labelSeparator = "\xff"
+
+func joinLabelValues(labels, values []string) string {
+	if len(labels) != len(values) {
+		panic(fmt.Sprintf("metrics: got %d label values for %d labels", len(values), len(labels)))
+	}
+	return strings.Join(values, labelSeparator)
+}
+
+// Format the labels for a sample as {name="value",...}, adding an extra label (such as
+// the "le" label of histogram buckets) if extraName isn't empty.
+func formatLabels(labels []string, key string, extraName, extraValue string) string {
+	if len(labels) == 0 && extraName == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+
+	if len(labels) > 0 {
+		for i, value := range strings.Split(key, labelSeparator) {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], escapeLabelValue(value))
+		}
+	}
+
+	if extraName != "" {
+		if len(labels) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", extraName, extraValue)
+	}
+
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(help), name, kind)
+}
+
+func writeSample(w *bufio.Writer, name, labels string, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(value))
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,307 @@
+// Package migrate applies the SQL migrations in an fs.FS to a PostgreSQL database. The
+// applied version is tracked in the same schema_migrations table that the migrate
+// command line tool uses, so databases migrated with either are interchangeable.
+package migrate
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// A Migration holds the SQL for a single numbered migration, read from a pair of files
+// named like "000001_citext.up.sql" and "000001_citext.down.sql".
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+var (
+	// ErrDirty is returned when a previous migration failed part way through, leaving
+	// the database in an unknown state. It has to be repaired by hand, and the dirty
+	// flag cleared in the schema_migrations table, before migrating again.
+	ErrDirty = errors.New("database is dirty")
+
+	// ErrUnknownVersion is returned when asked to migrate to a version which doesn't
+	// have a migration.
+	ErrUnknownVersion = errors.New("unknown migration version")
+)
+
+// The key for the advisory lock which stops two instances from migrating at once.
+const lockKey = 7_240_049
+
+var filenameRX = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// A Migrator applies migrations to a database.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// New reads the migrations from fsys and returns a Migrator for db. Every migration
+// must have both an up and a down file.
+func New(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+
+	for _, entry := range entries {
+		matches := filenameRX.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || matches == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version in %q", entry.Name())
+		}
+
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: matches[2]}
+			byVersion[version] = m
+		}
+
+		if m.Name != matches[2] {
+			return nil, fmt.Errorf("migration %d has files with different names", version)
+		}
+
+		switch matches[3] {
+		case "up":
+			m.Up = string(content)
+		case "down":
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d is missing its up or down file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	slices.SortFunc(migrations, func(a, b Migration) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Migrations returns all the migrations, in order.
+func (m *Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+// Latest returns the version of the most recent migration, which is the version that
+// the code expects the database to be at.
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Version returns the version the database is currently at, which is 0 if no
+// migrations have been applied, and whether it's dirty.
+func (m *Migrator) Version(ctx context.Context) (int64, bool, error) {
+	return version(ctx, m.db)
+}
+
+// Up applies all the migrations which haven't been applied yet, and returns the
+// versions that it applied.
+func (m *Migrator) Up(ctx context.Context) ([]int64, error) {
+	return m.Goto(ctx, m.Latest())
+}
+
+// Down rolls back the most recently applied migration, and returns its version.
+func (m *Migrator) Down(ctx context.Context) ([]int64, error) {
+	current, _, err := m.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current == 0 {
+		return nil, nil
+	}
+
+	i := m.index(current)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: database is at version %d", ErrUnknownVersion, current)
+	}
+
+	var target int64
+	if i > 0 {
+		target = m.migrations[i-1].Version
+	}
+
+	return m.Goto(ctx, target)
+}
+
+// Goto migrates the database up or down to the given version, where 0 means rolling
+// back every migration, and returns the versions of the migrations it applied or
+// rolled back, in the order it did so.
+//
+// Each migration runs in its own transaction along with the update to the
+// schema_migrations table, so a failed migration leaves the database at the previous
+// version rather than dirty. A session-level advisory lock is held throughout, so that
+// if several instances start at once only one of them migrates, and the others wait
+// and then find there's nothing left to do.
+func (m *Migrator) Goto(ctx context.Context, target int64) ([]int64, error) {
+	if target != 0 && m.index(target) < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownVersion, target)
+	}
+
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey)
+	if err != nil {
+		return nil, err
+	}
+	// Use a fresh context to release the lock, so it's released even if ctx has been
+	// cancelled. Closing the connection would release it too, but the connection goes
+	// back to the pool rather than being closed.
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockKey)
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version bigint NOT NULL PRIMARY KEY,
+			dirty boolean NOT NULL
+		)`)
+	if err != nil {
+		return nil, err
+	}
+
+	current, dirty, err := version(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	if dirty {
+		return nil, fmt.Errorf("%w at version %d", ErrDirty, current)
+	}
+
+	var done []int64
+
+	// Migrate up, applying each migration after the current version up to and
+	// including the target.
+	for _, migration := range m.migrations {
+		if migration.Version <= current || migration.Version > target {
+			continue
+		}
+
+		err := m.apply(ctx, conn, migration.Up, migration.Version)
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s up: %w", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration.Version)
+	}
+
+	// Or migrate down, rolling back each migration from the current version down to,
+	// but not including, the target. Only one of these loops does anything.
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if migration.Version > current || migration.Version <= target {
+			continue
+		}
+
+		var previous int64
+		if i > 0 {
+			previous = m.migrations[i-1].Version
+		}
+
+		err := m.apply(ctx, conn, migration.Down, previous)
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s down: %w", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration.Version)
+	}
+
+	return done, nil
+}
+
+// Run the SQL for a migration and record the new version in a single transaction. A
+// version of 0 means that no migrations are applied, which is recorded as an empty
+// table.
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, query string, newVersion int64) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `TRUNCATE schema_migrations`)
+	if err != nil {
+		return err
+	}
+
+	if newVersion > 0 {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, newVersion)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (m *Migrator) index(version int64) int {
+	return slices.IndexFunc(m.migrations, func(migration Migration) bool {
+		return migration.Version == version
+	})
+}
+
+// A queryRower is satisfied by *sql.DB and *sql.Conn.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Read the current version from the schema_migrations table. If the table doesn't
+// exist yet, no migrations have been applied.
+func version(ctx context.Context, db queryRower) (int64, bool, error) {
+	var exists bool
+
+	err := db.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists)
+	if err != nil || !exists {
+		return 0, false, err
+	}
+
+	var version int64
+	var dirty bool
+
+	err = db.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, false, nil
+		default:
+			return 0, false, err
+		}
+	}
+
+	return version, dirty, nil
+}
@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Memory is a Limiter which keeps a token bucket for each client in memory. It's fast,
+// but each instance of the API has its own buckets, and they are lost on restart.
+type Memory struct {
+	mu      sync.Mutex
+	clients map[string]*client
+}
+
+// A client holds the token bucket for a single client, and the last time it was used.
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// The amount of time after their last request that clients are removed by Cleanup().
+const memoryIdleTimeout = 3 * time.Minute
+
+// NewMemory returns a new in-memory Limiter.
+func NewMemory() *Memory {
+	return &Memory{clients: make(map[string]*client)}
+}
+
+func (m *Memory) Allow(ctx context.Context, key string, r Rate) (Result, error) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, found := m.clients[key]
+	if !found {
+		c = &client{limiter: rate.NewLimiter(rate.Limit(r.RPS), r.Burst)}
+		m.clients[key] = c
+	}
+
+	// The rate for a key can change if the configuration does, so make sure the
+	// bucket is up to date.
+	if c.limiter.Limit() != rate.Limit(r.RPS) {
+		c.limiter.SetLimitAt(now, rate.Limit(r.RPS))
+	}
+	if c.limiter.Burst() != r.Burst {
+		c.limiter.SetBurstAt(now, r.Burst)
+	}
+
+	c.lastSeen = now
+
+	result := Result{
+		Allowed: c.limiter.AllowN(now, 1),
+		Limit:   r.Burst,
+	}
+
+	tokens := c.limiter.TokensAt(now)
+	result.Remaining = max(0, int(math.Floor(tokens)))
+
+	// If the request wasn't allowed, the client has to wait for the bucket to refill
+	// up to one whole token.
+	if !result.Allowed && r.RPS > 0 {
+		result.RetryAfter = time.Duration((1 - tokens) / r.RPS * float64(time.Second))
+	}
+
+	return result, nil
+}
+
+func (m *Memory) Cleanup(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, c := range m.clients {
+		if time.Since(c.lastSeen) > memoryIdleTimeout {
+			delete(m.clients, key)
+		}
+	}
+
+	return nil
+}
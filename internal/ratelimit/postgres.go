@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"time"
+)
+
+// Postgres is a Limiter which keeps count of requests in the rate_limits table, so
+// that every instance of the API shares the same limits and they survive restarts.
+//
+// It uses a sliding window counter. Requests are counted in fixed windows, and the
+// number of requests in the sliding window ending now is estimated by adding the count
+// for the current window to a share of the count for the previous one, in proportion
+// to how much of the previous window the sliding window still overlaps. A Rate of RPS
+// requests per second with bursts of up to Burst requests becomes a limit of Burst
+// requests in each window of Burst/RPS seconds.
+type Postgres struct {
+	db *sql.DB
+}
+
+// NewPostgres returns a new Limiter which uses the given database.
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+func (p *Postgres) Allow(ctx context.Context, key string, r Rate) (Result, error) {
+	if r.RPS <= 0 || r.Burst <= 0 {
+		return Result{Limit: max(0, r.Burst)}, nil
+	}
+
+	window := time.Duration(float64(r.Burst) / r.RPS * float64(time.Second))
+
+	now := time.Now()
+	start := now.Truncate(window)
+	elapsed := now.Sub(start)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Result{}, err
+	}
+	defer tx.Rollback()
+
+	// Fetch the counts for the current and previous windows, creating the row for the
+	// current window if needed. The no-op update locks the row until the end of the
+	// transaction, so that concurrent requests from the same client are decided one at
+	// a time. Rows are kept until the end of the following window, after which they're
+	// no longer needed.
+	query := `
+		INSERT INTO rate_limits (key, window_start, count, expiry)
+		VALUES ($1, $2, 0, $3)
+		ON CONFLICT (key, window_start) DO UPDATE
+		SET count = rate_limits.count
+		RETURNING count, COALESCE((SELECT count FROM rate_limits WHERE key = $1 AND window_start = $4), 0)`
+
+	var current, previous float64
+
+	err = tx.QueryRowContext(ctx, query, key, start, start.Add(2*window), start.Add(-window)).Scan(&current, &previous)
+	if err != nil {
+		return Result{}, err
+	}
+
+	limit := float64(r.Burst)
+	weight := float64(window-elapsed) / float64(window)
+	estimate := previous*weight + current + 1
+
+	result := Result{
+		Allowed:   estimate <= limit,
+		Limit:     r.Burst,
+		Remaining: max(0, int(math.Floor(limit-estimate))),
+	}
+
+	// Like the in-memory limiter, only count the request if it's allowed.
+	if result.Allowed {
+		query = `
+			UPDATE rate_limits
+			SET count = count + 1
+			WHERE key = $1 AND window_start = $2`
+
+		_, err = tx.ExecContext(ctx, query, key, start)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Result{}, err
+	}
+
+	if !result.Allowed {
+		var wait float64
+
+		if current < limit {
+			// The client has to wait for enough of the previous window to slide out
+			// of the sliding window to make room for one more request.
+			wait = (1-(limit-current-1)/previous)*float64(window) - float64(elapsed)
+		} else {
+			// The client has used up the limit in this window alone, so has to wait
+			// until the next window, and then for enough of this one to slide out.
+			wait = float64(window-elapsed) + (1-(limit-1)/current)*float64(window)
+		}
+
+		result.RetryAfter = time.Duration(max(0, wait))
+	}
+
+	return result, nil
+}
+
+func (p *Postgres) Cleanup(ctx context.Context) error {
+	query := `
+		DELETE FROM rate_limits
+		WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	_, err := p.db.ExecContext(ctx, query)
+	return err
+}
@@ -0,0 +1,37 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// A Rate is the number of requests a client can make: a sustained rate of RPS requests
+// per second, with bursts of up to Burst requests.
+type Rate struct {
+	RPS   float64
+	Burst int
+}
+
+// A Result describes the outcome of a call to Allow(). Limit is the maximum number of
+// requests the client can make in a burst, and Remaining the number they have left.
+// When the request isn't allowed, RetryAfter is how long the client should wait before
+// trying again.
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+}
+
+// The Limiter interface is implemented by the stores which keep track of how many
+// requests each client has made. Clients are identified by a key, such as their IP
+// address.
+type Limiter interface {
+	// Allow records a request by the client with the given key, and reports whether
+	// it is within the rate. Only allowed requests count towards the limit, so clients
+	// which keep retrying while they're limited aren't held back for any longer.
+	Allow(ctx context.Context, key string, rate Rate) (Result, error)
+	// Cleanup removes the state kept for clients which haven't made any requests
+	// recently. It should be called regularly.
+	Cleanup(ctx context.Context) error
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Local stores objects as files in a directory on the local filesystem.
+type Local struct {
+	root string
+}
+
+// The NewLocal() function returns a Local storage which keeps its files under the root
+// directory, creating the directory if it doesn't exist.
+func NewLocal(root string) (*Local, error) {
+	err := os.MkdirAll(root, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Local{root: root}, nil
+}
+
+// The Put() method writes the object to a temporary file first and then renames it into
+// place, so that readers never see a partially written file.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader) error {
+	name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(name), 0o755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return err
+	}
+	// Clean up the temporary file if anything below fails. Once it's been renamed there
+	// is nothing left to remove.
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	// Check that the request wasn't cancelled while we were writing the file.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
+
+func (l *Local) Open(ctx context.Context, key string) (File, error) {
+	name, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(name)
+	if err != nil {
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			return ErrNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Convert a key into the path of its file. Keys which are absolute, contain ".."
+// elements or otherwise aren't in their clean form are rejected, so that a key can
+// never refer to a file outside of the root directory.
+func (l *Local) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.Contains(key, "..") || strings.Contains(key, "\\") {
+		return "", ErrInvalidKey
+	}
+
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// Define custom errors. ErrNotFound is returned when there is no object stored under a
+// key, and ErrInvalidKey when a key can't be used to store an object.
+var (
+	ErrNotFound   = errors.New("storage: object not found")
+	ErrInvalidKey = errors.New("storage: invalid key")
+)
+
+// A File is an object opened for reading. Being seekable and able to report its size
+// and modification time means it can be passed straight to http.ServeContent(), which
+// takes care of Range and conditional requests for us. An *os.File satisfies it.
+type File interface {
+	io.ReadSeekCloser
+	Stat() (fs.FileInfo, error)
+}
+
+// The Storage interface is implemented by the places we can store uploaded files.
+// Objects are identified by slash-separated keys like "covers/12/3fa9c1d2.jpg", and are
+// written in full by Put(), replacing any existing object with the same key.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Open(ctx context.Context, key string) (File, error)
+	Delete(ctx context.Context, key string) error
+}
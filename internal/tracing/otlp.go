@@ -0,0 +1,168 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// OTLPExporter sends spans to an OpenTelemetry collector using OTLP over HTTP, with the
+// JSON encoding so that we don't need protobuf. Anything which accepts a POST of OTLP
+// JSON to the endpoint will do, including a stub collector in tests.
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+	version     string
+	client      *http.Client
+}
+
+// NewOTLPExporter returns a new exporter which posts spans to endpoint, which is the
+// full URL of the traces endpoint, such as "http://localhost:4318/v1/traces". If client
+// is nil, a client with a 10 second timeout is used.
+func NewOTLPExporter(endpoint, serviceName, version string, client *http.Client) *OTLPExporter {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &OTLPExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		version:     version,
+		client:      client,
+	}
+}
+
+// The following types mirror the parts of the OTLP JSON encoding that we use. IDs are
+// hex strings, and timestamps are nanoseconds since the epoch encoded as strings, as
+// the OTLP JSON mapping requires.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// Status codes: 0 is unset, 2 is an error.
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func (e *OTLPExporter) Export(ctx context.Context, spans []SpanData) error {
+	scope := otlpScopeSpans{
+		Scope: otlpScope{Name: "bookworm.onatim.com/internal/tracing"},
+		Spans: make([]otlpSpan, 0, len(spans)),
+	}
+
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.ParentID.IsValid() {
+			span.ParentSpanID = s.ParentID.String()
+		}
+		if s.Err != nil {
+			span.Status = otlpStatus{Code: 2, Message: s.Err.Error()}
+		}
+
+		scope.Spans = append(scope.Spans, span)
+	}
+
+	body, err := json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: otlpAttributes(map[string]string{
+				"service.name":    e.serviceName,
+				"service.version": e.version,
+			})},
+			ScopeSpans: []otlpScopeSpans{scope},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Read the body so the connection can be reused, keeping a little of it for the
+	// error message if the collector rejected the spans.
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("otlp export: %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+func otlpAttributes(m map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		attrs = append(attrs, otlpAttribute{Key: key, Value: otlpAnyValue{StringValue: m[key]}})
+	}
+	return attrs
+}
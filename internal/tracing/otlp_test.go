@@ -0,0 +1,181 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector is a stub OpenTelemetry collector which records the spans posted to it.
+type collector struct {
+	mu       sync.Mutex
+	requests []otlpRequest
+	status   int
+}
+
+func newCollector(t *testing.T) (*collector, *httptest.Server) {
+	c := &collector{status: http.StatusOK}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.requests = append(c.requests, req)
+		w.WriteHeader(c.status)
+	}))
+	t.Cleanup(srv.Close)
+
+	return c, srv
+}
+
+func (c *collector) spans() []otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var spans []otlpSpan
+	for _, req := range c.requests {
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+func shutdown(t *testing.T, tracer *Tracer) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := tracer.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportToCollector(t *testing.T) {
+	c, srv := newCollector(t)
+
+	tracer := NewTracer(NewOTLPExporter(srv.URL, "bookworm", "v1.0.0", srv.Client()), Options{SampleRatio: 1})
+
+	ctx, root := tracer.StartRequest(context.Background(), "GET /v1/books", "")
+	_, child := StartKind(ctx, "BookModel.GetAll", SpanKindClient)
+	child.SetAttribute("db.system", "postgresql")
+	child.SetError(errors.New("boom"))
+	child.End()
+	root.End()
+
+	shutdown(t, tracer)
+
+	spans := c.spans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans; want 2", len(spans))
+	}
+
+	gotChild, gotRoot := spans[0], spans[1]
+
+	if gotRoot.Name != "GET /v1/books" || gotRoot.Kind != SpanKindServer || gotRoot.ParentSpanID != "" {
+		t.Errorf("unexpected root span: %+v", gotRoot)
+	}
+	if gotChild.TraceID != gotRoot.TraceID || gotChild.ParentSpanID != gotRoot.SpanID {
+		t.Errorf("child span isn't part of the root span's trace: %+v", gotChild)
+	}
+	if gotChild.Kind != SpanKindClient || gotChild.Status.Code != 2 || gotChild.Status.Message != "boom" {
+		t.Errorf("unexpected child span: %+v", gotChild)
+	}
+	if len(gotChild.Attributes) != 1 || gotChild.Attributes[0].Key != "db.system" || gotChild.Attributes[0].Value.StringValue != "postgresql" {
+		t.Errorf("unexpected child span attributes: %+v", gotChild.Attributes)
+	}
+
+	resource := c.requests[0].ResourceSpans[0].Resource.Attributes
+	if len(resource) != 2 || resource[0].Value.StringValue != "bookworm" || resource[1].Value.StringValue != "v1.0.0" {
+		t.Errorf("unexpected resource attributes: %+v", resource)
+	}
+}
+
+func TestExportJoinsCallerTrace(t *testing.T) {
+	c, srv := newCollector(t)
+
+	tracer := NewTracer(NewOTLPExporter(srv.URL, "bookworm", "v1.0.0", srv.Client()), Options{SampleRatio: 1})
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	_, span := tracer.StartRequest(context.Background(), "GET /v1/books", traceparent)
+	span.End()
+
+	shutdown(t, tracer)
+
+	spans := c.spans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans; want 1", len(spans))
+	}
+	if spans[0].TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || spans[0].ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("span didn't join the caller's trace: %+v", spans[0])
+	}
+}
+
+func TestCallerCannotForceSampling(t *testing.T) {
+	c, srv := newCollector(t)
+
+	tracer := NewTracer(NewOTLPExporter(srv.URL, "bookworm", "v1.0.0", srv.Client()), Options{SampleRatio: 0})
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	for i := 0; i < 10; i++ {
+		_, span := tracer.StartRequest(context.Background(), "GET /v1/books", traceparent)
+		if span.Context().Sampled {
+			t.Fatal("span was sampled with a sample ratio of 0")
+		}
+		span.End()
+	}
+
+	shutdown(t, tracer)
+
+	if spans := c.spans(); len(spans) != 0 {
+		t.Errorf("got %d spans; want 0", len(spans))
+	}
+}
+
+func TestExportError(t *testing.T) {
+	c, srv := newCollector(t)
+	c.status = http.StatusServiceUnavailable
+
+	var mu sync.Mutex
+	var exportErr error
+
+	tracer := NewTracer(NewOTLPExporter(srv.URL, "bookworm", "v1.0.0", srv.Client()), Options{
+		SampleRatio: 1,
+		ErrorLog: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			exportErr = err
+		},
+	})
+
+	_, span := tracer.StartRequest(context.Background(), "GET /v1/books", "")
+	span.End()
+
+	shutdown(t, tracer)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if exportErr == nil {
+		t.Fatal("expected the export error to be logged")
+	}
+}
@@ -0,0 +1,470 @@
+// Package tracing records spans for requests and the work done while serving them, so
+// that a slow request can be followed through the API and into the database. Trace
+// context is propagated using the W3C traceparent header, and finished spans are handed
+// to an Exporter in batches.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A TraceID identifies a trace, which is made up of every span recorded for a request,
+// including those recorded by other services.
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether the ID is non-zero, as the all-zero ID is invalid.
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// A SpanID identifies a single span within a trace.
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether the ID is non-zero, as the all-zero ID is invalid.
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// A SpanContext is the part of a span which is propagated to other services: the trace
+// it belongs to, its own ID, and whether the trace is being sampled.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// ParseTraceparent parses a W3C traceparent header, in the form
+// "00-<trace-id>-<span-id>-<flags>". It returns false if the header is missing or
+// invalid, in which case a new trace should be started.
+func ParseTraceparent(header string) (SpanContext, bool) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 {
+		return sc, false
+	}
+
+	// Version ff is forbidden. Later versions may add more fields, but must keep the
+	// first four as they are, so only version 00 has to have exactly four.
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 || version[0] == 0xff || (version[0] == 0 && len(parts) != 4) {
+		return sc, false
+	}
+
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) {
+		return sc, false
+	}
+	if !sc.TraceID.IsValid() || !sc.SpanID.IsValid() {
+		return sc, false
+	}
+
+	var flags [1]byte
+	if !decodeHex(flags[:], parts[3]) {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&0x01 == 0x01
+
+	return sc, true
+}
+
+// Decode a lowercase hex string into dst, which it must exactly fill.
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// Traceparent formats the span context as a W3C traceparent header.
+func (sc SpanContext) Traceparent() string {
+	flags := 0
+	if sc.Sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags)
+}
+
+// SpanKind describes the relationship between a span and the work it represents, using
+// the same values as OpenTelemetry.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// A Span records a single operation within a trace, such as serving a request or
+// running a query. All methods are safe to call on a nil *Span, which is what Start()
+// returns when there's no trace to record the span in, so callers never need to check.
+type Span struct {
+	tracer *Tracer
+
+	mu         sync.Mutex
+	name       string
+	kind       SpanKind
+	context    SpanContext
+	parentID   SpanID
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        error
+	ended      bool
+}
+
+// SpanData is a read-only copy of a finished span, as passed to an Exporter.
+type SpanData struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	ParentID   SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Err        error
+}
+
+// Context returns the span context, for propagating it to other services.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// TraceID returns the ID of the trace the span belongs to as a hex string, or an empty
+// string for a nil span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.context.TraceID.String()
+}
+
+// SetName changes the name of the span. It's useful when a better name is only known
+// once the work is done, like the route that a request matched.
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+// SetAttribute records a key/value attribute on the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed with the given error.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// End finishes the span and queues it for export. Only the first call has any effect,
+// so it's safe to both defer End() and call it earlier.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+
+	data := SpanData{
+		Name:       s.name,
+		Kind:       s.kind,
+		Context:    s.context,
+		ParentID:   s.parentID,
+		Start:      s.start,
+		End:        s.end,
+		Attributes: s.attributes,
+		Err:        s.err,
+	}
+	s.mu.Unlock()
+
+	if s.context.Sampled {
+		s.tracer.enqueue(data)
+	}
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpan returns a copy of ctx holding the given span, so that spans started
+// from it become children of that span.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+// SpanFromContext returns the current span in ctx, or nil if there isn't one.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// Start starts a new internal span as a child of the current span in ctx, returning a
+// copy of ctx holding the new span. If ctx doesn't hold a span (for example, in a
+// background job which isn't part of any request) nothing is recorded, and the returned
+// span is nil.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return StartKind(ctx, name, SpanKindInternal)
+}
+
+// StartKind is like Start(), but sets the kind of the span. Spans for calls to other
+// services, such as the database or an SMTP server, should be SpanKindClient.
+func StartKind(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	span := parent.tracer.newSpan(name, kind, SpanContext{
+		TraceID: parent.context.TraceID,
+		SpanID:  newSpanID(),
+		Sampled: parent.context.Sampled,
+	}, parent.context.SpanID)
+
+	return ContextWithSpan(ctx, span), span
+}
+
+// An Exporter sends finished spans somewhere, like an OpenTelemetry collector.
+type Exporter interface {
+	Export(ctx context.Context, spans []SpanData) error
+}
+
+// Options configure a Tracer.
+type Options struct {
+	// SampleRatio is the fraction of traces to record, from 0 to 1. Requests with a
+	// traceparent header are only recorded if the caller sampled them too, so callers
+	// can turn sampling off but can't force more traces to be exported than this.
+	SampleRatio float64
+	// BatchSize is the number of spans sent to the exporter at once, and BatchTimeout
+	// the longest that a finished span waits before it's sent.
+	BatchSize    int
+	BatchTimeout time.Duration
+	// QueueSize is the number of finished spans which can wait to be exported. If the
+	// exporter falls behind, spans are dropped rather than blocking requests.
+	QueueSize int
+	// ErrorLog is called when the exporter returns an error.
+	ErrorLog func(error)
+}
+
+// A Tracer starts root spans for incoming requests and exports finished spans in the
+// background.
+type Tracer struct {
+	exporter Exporter
+	opts     Options
+	queue    chan SpanData
+	flush    chan chan struct{}
+	done     chan struct{}
+}
+
+// NewTracer returns a new Tracer which sends spans to the given exporter, and starts
+// its background export goroutine. If exporter is nil, spans still get IDs, so that
+// trace IDs appear in logs and responses, but nothing is exported.
+func NewTracer(exporter Exporter, opts Options) *Tracer {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 512
+	}
+	if opts.BatchTimeout <= 0 {
+		opts.BatchTimeout = 5 * time.Second
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 2048
+	}
+
+	t := &Tracer{
+		exporter: exporter,
+		opts:     opts,
+		queue:    make(chan SpanData, opts.QueueSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if exporter != nil {
+		go t.run()
+	}
+
+	return t
+}
+
+// StartRequest starts the root span for an incoming request. If the request carried a
+// valid traceparent header, the span joins the caller's trace as a child of their span;
+// otherwise a new trace is started.
+func (t *Tracer) StartRequest(ctx context.Context, name, traceparent string) (context.Context, *Span) {
+	parent, ok := ParseTraceparent(traceparent)
+
+	sc := SpanContext{SpanID: newSpanID()}
+	if ok {
+		// Anyone can send a traceparent header, so the caller's sampled flag is
+		// combined with our own decision. That's made from a new random ID rather than
+		// the caller's trace ID, which they could pick to always be sampled.
+		sc.TraceID = parent.TraceID
+		sc.Sampled = parent.Sampled && t.sample(newTraceID())
+	} else {
+		sc.TraceID = newTraceID()
+		sc.Sampled = t.sample(sc.TraceID)
+	}
+
+	span := t.newSpan(name, SpanKindServer, sc, parent.SpanID)
+	return ContextWithSpan(ctx, span), span
+}
+
+func (t *Tracer) newSpan(name string, kind SpanKind, sc SpanContext, parentID SpanID) *Span {
+	return &Span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		context:    sc,
+		parentID:   parentID,
+		start:      time.Now(),
+		attributes: make(map[string]string),
+	}
+}
+
+// Make the sampling decision for a new trace from its ID, which is random, so that the
+// same trace ID always gets the same decision.
+func (t *Tracer) sample(id TraceID) bool {
+	switch {
+	case t.exporter == nil || t.opts.SampleRatio <= 0:
+		return false
+	case t.opts.SampleRatio >= 1:
+		return true
+	}
+
+	var n uint64
+	for _, b := range id[8:] {
+		n = n<<8 | uint64(b)
+	}
+	return float64(n>>11)/(1<<53) < t.opts.SampleRatio
+}
+
+func (t *Tracer) enqueue(span SpanData) {
+	if t.exporter == nil {
+		return
+	}
+
+	select {
+	case t.queue <- span:
+	default:
+		// The queue is full, so drop the span.
+	}
+}
+
+// The run() method collects finished spans into batches, and sends each batch to the
+// exporter when it's full, when the batch timeout expires or when a flush is requested.
+func (t *Tracer) run() {
+	batch := make([]SpanData, 0, t.opts.BatchSize)
+
+	ticker := time.NewTicker(t.opts.BatchTimeout)
+	defer ticker.Stop()
+
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		err := t.exporter.Export(ctx, batch)
+		if err != nil && t.opts.ErrorLog != nil {
+			t.opts.ErrorLog(err)
+		}
+
+		batch = make([]SpanData, 0, t.opts.BatchSize)
+	}
+
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= t.opts.BatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case reply := <-t.flush:
+			// Drain whatever is already queued before exporting.
+			for draining := true; draining; {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+					if len(batch) >= t.opts.BatchSize {
+						export()
+					}
+				default:
+					draining = false
+				}
+			}
+			export()
+			close(reply)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// Shutdown exports any spans that are still queued and stops the background goroutine.
+// It should be called once no more spans will be ended, after the server has shut down.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t.exporter == nil {
+		return nil
+	}
+
+	reply := make(chan struct{})
+
+	select {
+	case t.flush <- reply:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-reply:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	close(t.done)
+	return nil
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
@@ -0,0 +1,8 @@
+ALTER TABLE
+    books
+ADD
+    COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS books_deleted_at_idx ON books (deleted_at)
+WHERE
+    deleted_at IS NOT NULL;
\ No newline at end of file
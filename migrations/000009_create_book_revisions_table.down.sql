@@ -0,0 +1 @@
+DROP TABLE IF EXISTS book_revisions;
\ No newline at end of file
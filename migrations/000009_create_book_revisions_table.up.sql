@@ -0,0 +1,14 @@
+-- The book_id column deliberately has no foreign key to books, so that the revisions of
+-- a book are kept as its audit history after it has been purged from the trash.
+CREATE TABLE IF NOT EXISTS book_revisions (
+    id bigserial PRIMARY KEY,
+    book_id bigint NOT NULL,
+    version integer NOT NULL,
+    action text NOT NULL,
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    changes jsonb NOT NULL,
+    state jsonb NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS book_revisions_book_id_version_idx ON book_revisions (book_id, version);
\ No newline at end of file
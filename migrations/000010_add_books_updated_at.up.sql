@@ -0,0 +1,9 @@
+ALTER TABLE
+    books
+ADD
+    COLUMN IF NOT EXISTS updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+
+UPDATE
+    books
+SET
+    updated_at = created_at;
\ No newline at end of file
@@ -0,0 +1,4 @@
+ALTER TABLE
+    books
+ADD
+    COLUMN IF NOT EXISTS cover text NOT NULL DEFAULT '';
\ No newline at end of file
@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'books:download';
+
+DROP TABLE IF EXISTS book_files;
\ No newline at end of file
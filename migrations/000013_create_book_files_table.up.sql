@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS book_files (
+    id bigserial PRIMARY KEY,
+    book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+    format text NOT NULL,
+    key text NOT NULL,
+    size bigint NOT NULL,
+    checksum text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    UNIQUE (book_id, format)
+);
+
+-- Add the permission to download ebook files.
+INSERT INTO
+    permissions (code)
+VALUES
+    ('books:download');
\ No newline at end of file
@@ -0,0 +1,16 @@
+-- Restore the original genres of the books changed by the up migration. Any changes
+-- made to their genres since then are lost.
+UPDATE
+    books
+SET
+    genres = genres_before_taxonomy,
+    updated_at = NOW(),
+    version = version + 1
+WHERE
+    genres_before_taxonomy IS NOT NULL;
+
+ALTER TABLE
+    books DROP COLUMN IF EXISTS genres_before_taxonomy;
+
+DROP TABLE IF EXISTS genre_aliases;
+DROP TABLE IF EXISTS genres;
\ No newline at end of file
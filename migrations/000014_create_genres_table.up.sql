@@ -0,0 +1,113 @@
+CREATE TABLE IF NOT EXISTS genres (
+    id bigserial PRIMARY KEY,
+    slug text NOT NULL UNIQUE,
+    name text NOT NULL,
+    parent_id bigint REFERENCES genres ON DELETE SET NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS genre_aliases (
+    alias text PRIMARY KEY,
+    genre_id bigint NOT NULL REFERENCES genres ON DELETE CASCADE
+);
+
+-- Seed the taxonomy with the genres already used by books, as top-level genres. The
+-- slugs are made in the same way as data.Slugify(), keeping letters and digits in any
+-- script, which relies on the database having a UTF-8 locale (as the setup script
+-- creates).
+INSERT INTO
+    genres (slug, name)
+SELECT
+    DISTINCT ON (slug) slug, name
+FROM
+    (
+        SELECT
+            trim(both '-' FROM regexp_replace(lower(g), '[^[:alnum:]]+', '-', 'g')) AS slug,
+            g AS name
+        FROM
+            books,
+            unnest(genres) AS g
+    ) AS existing
+WHERE
+    slug <> ''
+ORDER BY
+    slug,
+    name;
+
+-- Keep a copy of the original genres of each book that's changed below, so that the
+-- down migration can restore them.
+ALTER TABLE
+    books
+ADD
+    COLUMN IF NOT EXISTS genres_before_taxonomy text [];
+
+-- Replace the free-text genres in books with their slugs, keeping the original order,
+-- and bump the version of each book that changes. Books whose genres would all be
+-- removed (because they contain no letters or digits) are left as they are, and
+-- reported below, rather than silently losing their genres.
+WITH normalized AS (
+    SELECT
+        id,
+        ARRAY(
+            SELECT
+                slug
+            FROM
+                (
+                    SELECT
+                        trim(both '-' FROM regexp_replace(lower(g), '[^[:alnum:]]+', '-', 'g')) AS slug,
+                        min(n) AS n
+                    FROM
+                        unnest(books.genres) WITH ORDINALITY AS t(g, n)
+                    GROUP BY
+                        1
+                ) AS slugs
+            WHERE
+                slug <> ''
+            ORDER BY
+                n
+        ) AS genres
+    FROM
+        books
+)
+UPDATE
+    books
+SET
+    genres_before_taxonomy = books.genres,
+    genres = normalized.genres,
+    updated_at = NOW(),
+    version = books.version + 1
+FROM
+    normalized
+WHERE
+    books.id = normalized.id
+    AND books.genres IS DISTINCT FROM normalized.genres
+    AND (
+        cardinality(normalized.genres) > 0
+        OR cardinality(books.genres) = 0
+    );
+
+DO $$
+DECLARE
+    skipped bigint;
+BEGIN
+    SELECT
+        count(*) INTO skipped
+    FROM
+        books
+    WHERE
+        cardinality(genres) > 0
+        AND genres_before_taxonomy IS NULL
+        AND NOT EXISTS (
+            SELECT
+                1
+            FROM
+                unnest(genres) AS g
+            WHERE
+                g ~ '[[:alnum:]]'
+        );
+
+    IF skipped > 0 THEN
+        RAISE WARNING '% books kept their original genres, as none of them contain a letter or digit', skipped;
+    END IF;
+END $$;
\ No newline at end of file
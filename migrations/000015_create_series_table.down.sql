@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS books_series_idx;
+
+ALTER TABLE
+    books DROP COLUMN IF EXISTS series_position,
+    DROP COLUMN IF EXISTS series_id;
+
+DROP TABLE IF EXISTS series;
\ No newline at end of file
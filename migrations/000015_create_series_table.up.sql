@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS series (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    title text NOT NULL,
+    description text NOT NULL DEFAULT '',
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS series_title_idx ON series USING GIN (to_tsvector('simple', title));
+
+ALTER TABLE
+    books
+ADD
+    COLUMN IF NOT EXISTS series_id bigint REFERENCES series ON DELETE SET NULL,
+ADD
+    COLUMN IF NOT EXISTS series_position numeric;
+
+CREATE INDEX IF NOT EXISTS books_series_idx ON books (series_id, series_position)
\ No newline at end of file
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS book_similarities (
+    book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+    similar_book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+    score double precision NOT NULL,
+    PRIMARY KEY (book_id, similar_book_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_recommendations (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    book_id bigint NOT NULL REFERENCES books ON DELETE CASCADE,
+    score double precision NOT NULL,
+    PRIMARY KEY (user_id, book_id)
+);
\ No newline at end of file
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS rate_limits (
+    key text NOT NULL,
+    window_start timestamp with time zone NOT NULL,
+    count integer NOT NULL,
+    expiry timestamp with time zone NOT NULL,
+    PRIMARY KEY (key, window_start)
+);
+
+CREATE INDEX IF NOT EXISTS rate_limits_expiry_idx ON rate_limits (expiry);
\ No newline at end of file
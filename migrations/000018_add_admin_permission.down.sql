@@ -0,0 +1,4 @@
+DELETE FROM
+    permissions
+WHERE
+    code = 'admin:write';
\ No newline at end of file
@@ -0,0 +1,5 @@
+-- Add a permission for changing the running server's settings, such as its log level.
+INSERT INTO
+    permissions (code)
+VALUES
+    ('admin:write');
\ No newline at end of file
@@ -0,0 +1,10 @@
+// Package migrations embeds the SQL migration files, so that the api binary can apply
+// them itself and always carries the migrations which match its code.
+package migrations
+
+import "embed"
+
+// FS holds the up and down migrations, named like "000001_citext.up.sql".
+//
+//go:embed *.sql
+var FS embed.FS